@@ -0,0 +1,169 @@
+package staticfiles
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ArchiveFormat defines the archive format written by Storage.CollectToArchive.
+type ArchiveFormat int
+
+const (
+	ArchiveTarGz ArchiveFormat = iota // gzip-compressed tar archive
+	ArchiveZip                        // zip archive
+)
+
+// ErrUnknownArchiveFormat is returned by Storage.CollectToArchive
+// for the formats other than the listed ArchiveFormat constants.
+var ErrUnknownArchiveFormat = errors.New("unknown archive format")
+
+// archiveWriter adds files to the archive.
+type archiveWriter interface {
+	add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type tarGzWriter struct {
+	zw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzWriter) add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err = a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarGzWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.zw.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipWriter) add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	fw, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (a *zipWriter) Close() error {
+	return a.zw.Close()
+}
+
+func newArchiveWriter(w io.Writer, format ArchiveFormat) (archiveWriter, error) {
+	switch format {
+	case ArchiveTarGz:
+		zw := gzip.NewWriter(w)
+		return &tarGzWriter{zw: zw, tw: tar.NewWriter(zw)}, nil
+	case ArchiveZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, ErrUnknownArchiveFormat
+}
+
+// CollectToArchive collects files like CollectStatic does and writes the storage files,
+// their compressed copies and the manifest to w as a single archive in the format.
+// Archive entries are named by the storage relative file paths.
+func (s *Storage) CollectToArchive(w io.Writer, format ArchiveFormat) error {
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	err = s.CollectStatic()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range s.archiveEntries() {
+		err = s.addToArchive(aw, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return aw.Close()
+}
+
+// archiveEntries returns sorted storage relative paths of the existing
+// storage files, their compressed and latest copies and the manifest files.
+func (s *Storage) archiveEntries() []string {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+
+	addIfExists := func(name string) {
+		if seen[name] {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(s.OutputDir, name)); err == nil {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, sf := range s.FilesMap {
+		addIfExists(sf.StorageRelPath)
+		for _, ext := range compressedExtensions {
+			addIfExists(sf.StorageRelPath + ext)
+		}
+		if sf.LatestRelPath != "" {
+			addIfExists(sf.LatestRelPath)
+		}
+	}
+
+	addIfExists(ManifestFilename)
+	addIfExists(ManifestGzipFilename)
+	addIfExists(ManifestChecksumFilename)
+
+	sort.Strings(names)
+	return names
+}
+
+func (s *Storage) addToArchive(aw archiveWriter, name string) error {
+	f, err := os.Open(filepath.Join(s.OutputDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return aw.add(name, info, f)
+}
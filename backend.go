@@ -0,0 +1,144 @@
+package staticfiles
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// OutputBackend writes the storage files and the manifest, e.g. to the file system
+// or directly to a cloud storage. Paths are the file paths joined with the
+// Storage.OutputDir. The backends other than FileBackend are write-only:
+// the storage files are written with them but never read back. PostProcessCSS
+// writes the rewritten files with the backend, while the Storage options reading
+// the storage files, i.e. Gzip, Brotli, VerifyOnOpen, EmitLatestAlias, FailOnBrokenReferences
+// and the output mirrors, make the collection return UnsupportedOptionError.
+// Rules reading the storage files, e.g. PostProcessTemplate and ImageOptimizerRule,
+// must not be registered with such backends. Directories are created only
+// by the DirBackend.
+type OutputBackend interface {
+	// Write creates or replaces the file with the path with the content read from r.
+	// It returns the number of bytes written.
+	Write(path string, r io.Reader) (int64, error)
+	// Exists reports whether the file with the path exists.
+	Exists(path string) (bool, error)
+	// Delete removes the file with the path. Missing files are ignored.
+	Delete(path string) error
+}
+
+// DirBackend is the OutputBackend able to create directories,
+// e.g. to preserve the empty ones with the Storage.PreserveEmptyDirs.
+type DirBackend interface {
+	OutputBackend
+	// MkdirAll creates the directory with the path along with the missing parents.
+	MkdirAll(path string) error
+}
+
+// UnsupportedOptionError is returned by the collection when the Storage option
+// can't be used with the Storage.OutputBackend.
+type UnsupportedOptionError struct {
+	Option string // name of the Storage field or method enabling the option
+}
+
+func (e *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("option %s isn't supported by the output backend", e.Option)
+}
+
+// FileBackend is the OutputBackend writing files to the local file system.
+// It's used by default.
+type FileBackend struct{}
+
+func (FileBackend) Write(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func (FileBackend) Exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (FileBackend) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (FileBackend) Delete(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// outputBackend returns the Storage.OutputBackend or the FileBackend if it's not set.
+func (s *Storage) outputBackend() OutputBackend {
+	if s.OutputBackend == nil {
+		return FileBackend{}
+	}
+	return s.OutputBackend
+}
+
+// mkdirAll creates the directory with the Storage.OutputBackend if it's the DirBackend.
+// Other backends, e.g. cloud storages, have no directories to create.
+func (s *Storage) mkdirAll(dir string) error {
+	if backend, ok := s.outputBackend().(DirBackend); ok {
+		return backend.MkdirAll(dir)
+	}
+	return nil
+}
+
+// checkOutput makes sure the Storage.OutputDir is writable with the FileBackend.
+// With the other backends it returns UnsupportedOptionError for the enabled options
+// reading the storage files, see OutputBackend.
+func (s *Storage) checkOutput() error {
+	backend := s.outputBackend()
+	if _, ok := backend.(FileBackend); ok {
+		return checkWritable(s.OutputDir)
+	}
+
+	_, dirs := backend.(DirBackend)
+	options := []struct {
+		name    string
+		enabled bool
+	}{
+		{"Gzip", s.Gzip},
+		{"Brotli", s.Brotli != nil},
+		{"VerifyOnOpen", s.VerifyOnOpen},
+		{"EmitLatestAlias", s.EmitLatestAlias},
+		{"FailOnBrokenReferences", s.FailOnBrokenReferences},
+		{"AddOutputMirror", len(s.outputMirrors) > 0},
+		{"PreserveEmptyDirs", s.PreserveEmptyDirs && !dirs},
+	}
+
+	for _, option := range options {
+		if option.enabled {
+			return &UnsupportedOptionError{Option: option.name}
+		}
+	}
+	return nil
+}
+
+// writeOutput writes the content of the size read from r to the file with the path
+// with the Storage.OutputBackend. It returns ErrCopySizeMismatch if the backend
+// reports the different number of bytes written, e.g. on a short write.
+func (s *Storage) writeOutput(path string, r io.Reader, size int64) error {
+	n, err := s.outputBackend().Write(path, r)
+	if err == nil && n != size {
+		err = ErrCopySizeMismatch
+	}
+	return err
+}
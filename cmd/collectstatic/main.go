@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"github.com/catcombo/go-staticfiles"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type arrayString []string
@@ -19,27 +26,93 @@ func (a *arrayString) Set(value string) error {
 }
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout))
+}
+
+// run executes the command with the arguments and returns the exit code.
+func run(args []string, in io.Reader, out io.Writer) int {
 	var outputDir string
 	var inputDirs []string
 	var ignorePatterns []string
+	var ignoreHidden bool
+	var resolvePath string
+	var fromStdin bool
+	var gzip bool
+	var brotli bool
+	var verify bool
+	var watchChanges bool
+	var compressExts []string
+	var noHashExts []string
 
-	flag.StringVar(&outputDir, "output", "", "Output directory (required)")
-	flag.Var((*arrayString)(&inputDirs), "input", "Input directory(ies)")
-	flag.Var((*arrayString)(&ignorePatterns), "ignore", "Ignore files, directories, or paths matching glob-style pattern")
-	flag.Parse()
+	flags := flag.NewFlagSet("collectstatic", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&outputDir, "output", "", "Output directory (required)")
+	flags.Var((*arrayString)(&inputDirs), "input", "Input directory(ies)")
+	flags.Var((*arrayString)(&ignorePatterns), "ignore", "Ignore files, directories, or paths matching glob-style pattern")
+	flags.BoolVar(&ignoreHidden, "ignore-hidden", false, "Ignore hidden and editor temporary files")
+	flags.StringVar(&resolvePath, "resolve", "", "Print the storage path of the file from the existing manifest without collecting files")
+	flags.BoolVar(&fromStdin, "stdin", false, "Collect only the files listed in stdin one per line and merge them into the existing manifest")
+	flags.BoolVar(&verify, "verify", false, "Check that all files listed in the existing manifest exist without collecting files")
+	flags.BoolVar(&watchChanges, "watch", false, "Keep running and recollect the changed files until interrupted")
+	flags.BoolVar(&gzip, "gzip", false, "Write gzip-compressed copies of the compressible files")
+	flags.BoolVar(&brotli, "brotli", false, "Write brotli-compressed copies of the compressible files with the brotli command line tool")
+	flags.Var((*arrayString)(&compressExts), "compress-ext", "Compress only the files with the extension(s), e.g. .css")
+	flags.Var((*arrayString)(&noHashExts), "no-hash-ext", "Copy the files with the extension(s) keeping their names, e.g. .map")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
 
 	if outputDir == "" {
-		fmt.Println("Output directory required")
-		flag.Usage()
-		os.Exit(2)
+		fmt.Fprintln(out, "Output directory required")
+		flags.Usage()
+		return 2
 	}
 
 	storage, err := staticfiles.NewStorage(outputDir)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	if resolvePath != "" {
+		storagePath, err := storage.ResolveE(resolvePath)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %s\n", resolvePath, err)
+			return 1
+		}
+
+		fmt.Fprintln(out, storagePath)
+		return 0
+	}
+
+	if verify {
+		err = storage.Verify()
+		if missingErr, ok := err.(*staticfiles.MissingFilesError); ok {
+			fmt.Fprintln(out, "Missing files:")
+			for _, storageRelPath := range missingErr.StorageRelPaths {
+				fmt.Fprintln(out, storageRelPath)
+			}
+			return 1
+		} else if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+
+		fmt.Fprintf(out, "%d files verified\n", len(storage.FilesMap))
+		return 0
 	}
+
 	storage.Verbose = true
+	storage.IgnoreHidden = ignoreHidden
+	storage.Gzip = gzip
+	if brotli {
+		storage.Brotli = staticfiles.CommandEncoder(brotliCommand[0], brotliCommand[1:]...)
+	}
+
+	if len(compressExts) > 0 {
+		storage.CompressibleExtensions = compressExts
+	}
+	storage.NoHashExtensions = noHashExts
 
 	for _, dir := range inputDirs {
 		storage.AddInputDir(dir)
@@ -49,9 +122,92 @@ func main() {
 		storage.AddIgnorePattern(pattern)
 	}
 
-	err = storage.CollectStatic()
+	if fromStdin {
+		var paths []string
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			if path := strings.TrimSpace(scanner.Text()); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+
+		err = storage.CollectFiles(paths)
+	} else {
+		err = storage.CollectStatic()
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	if gzip || brotli {
+		fmt.Fprintf(out, "%d compressed files written\n", countCompressed(storage))
+	}
+
+	if watchChanges {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		defer signal.Stop(signals)
+
+		return watch(storage, out, signals)
+	}
+
+	return 0
+}
+
+// brotliCommand is the command writing the brotli-compressed copies with the -brotli flag.
+// It reads the file content from stdin and writes the compressed one to stdout.
+var brotliCommand = []string{"brotli", "--best", "--stdout"}
+
+// watchInterval is the interval between the input directories polls in the watch mode.
+var watchInterval = 500 * time.Millisecond
+
+// watch recollects the changed files and logs the rebuilds
+// until a signal is received, then stops the watcher.
+func watch(storage *staticfiles.Storage, out io.Writer, signals <-chan os.Signal) int {
+	var lock sync.Mutex
+
+	err := storage.Watch(watchInterval, func(paths []string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if err != nil {
+			fmt.Fprintf(out, "Rebuild failed: %s\n", err)
+		} else {
+			fmt.Fprintf(out, "Rebuilt %d changed files: %s\n", len(paths), strings.Join(paths, ", "))
+		}
+	})
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	lock.Lock()
+	fmt.Fprintln(out, "Watching for changes, press Ctrl+C to stop")
+	lock.Unlock()
+
+	<-signals
+
+	if err = storage.Close(); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+// countCompressed returns the number of the compressed copies of the storage files.
+func countCompressed(storage *staticfiles.Storage) int {
+	count := 0
+	for _, sf := range storage.FilesMap {
+		for _, ext := range []string{staticfiles.GzipExt, staticfiles.BrotliExt} {
+			if _, err := os.Stat(filepath.Join(storage.OutputDir, sf.StorageRelPath+ext)); err == nil {
+				count++
+			}
+		}
 	}
+	return count
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"github.com/catcombo/go-staticfiles"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRun_Resolve(t *testing.T) {
+	var out bytes.Buffer
+	code := run([]string{"-output", "../../testdata/expected/base", "-resolve", "css/style.css"}, nil, &out)
+
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "css/style.98718311206c.css\n", out.String())
+}
+
+func TestRun_Resolve_NotFound(t *testing.T) {
+	var out bytes.Buffer
+	code := run([]string{"-output", "../../testdata/expected/base", "-resolve", "file-not-exist"}, nil, &out)
+
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "file-not-exist: asset not found\n", out.String())
+}
+
+func TestRun_OutputRequired(t *testing.T) {
+	var out bytes.Buffer
+	code := run([]string{"-resolve", "css/style.css"}, nil, &out)
+
+	assert.Equal(t, 2, code)
+	assert.Contains(t, out.String(), "Output directory required")
+}
+
+func TestRun_Stdin(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "collectstatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	var out bytes.Buffer
+	in := strings.NewReader("../../testdata/input/base/img/pix.png\n\n")
+	code := run([]string{"-output", outputDir, "-input", "../../testdata/input/base", "-stdin"}, in, &out)
+	assert.Equal(t, 0, code, out.String())
+
+	out.Reset()
+	code = run([]string{"-output", outputDir, "-resolve", "img/pix.png"}, nil, &out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "img/pix.3eaf17869bb5.png\n", out.String())
+
+	out.Reset()
+	code = run([]string{"-output", outputDir, "-resolve", "css/style.css"}, nil, &out)
+	assert.Equal(t, 1, code)
+}
+
+func TestRun_Gzip(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "collectstatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	var out bytes.Buffer
+	code := run([]string{"-output", outputDir, "-input", "../../testdata/input/base", "-gzip", "-compress-ext", ".css"}, nil, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), "2 compressed files written\n")
+
+	_, err = os.Stat(filepath.Join(outputDir, "css/style.98718311206c.css.gz"))
+	assert.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(outputDir, "css/style.css.8a80554c91d9.map.gz"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRun_Brotli(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "collectstatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	// The brotli tool may be missing, the copies are written as is
+	defer func(command []string) { brotliCommand = command }(brotliCommand)
+	brotliCommand = []string{"cat"}
+
+	var out bytes.Buffer
+	code := run([]string{"-output", outputDir, "-input", "../../testdata/input/base", "-gzip", "-brotli", "-compress-ext", ".css"}, nil, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Contains(t, out.String(), "4 compressed files written\n")
+
+	storagePath := filepath.Join(outputDir, "css/style.98718311206c.css")
+	content, err := ioutil.ReadFile(storagePath + staticfiles.BrotliExt)
+	assert.NoError(t, err)
+
+	expected, err := ioutil.ReadFile(storagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, content)
+
+	_, err = os.Stat(storagePath + staticfiles.GzipExt)
+	assert.NoError(t, err)
+}
+
+func TestRun_NoHashExt(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "collectstatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	var out bytes.Buffer
+	code := run([]string{"-output", outputDir, "-input", "../../testdata/input/base", "-no-hash-ext", ".map"}, nil, &out)
+	assert.Equal(t, 0, code, out.String())
+
+	_, err = os.Stat(filepath.Join(outputDir, "css/style.css.map"))
+	assert.NoError(t, err)
+
+	out.Reset()
+	code = run([]string{"-output", outputDir, "-resolve", "css/style.css.map"}, nil, &out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "css/style.css.map\n", out.String())
+
+	out.Reset()
+	code = run([]string{"-output", outputDir, "-resolve", "css/style.css"}, nil, &out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "css/style.98718311206c.css\n", out.String())
+}
+
+func TestRun_Verify(t *testing.T) {
+	var out bytes.Buffer
+	code := run([]string{"-output", "../../testdata/expected/base", "-verify"}, nil, &out)
+	assert.Equal(t, 0, code, out.String())
+	assert.Equal(t, "4 files verified\n", out.String())
+
+	outputDir, err := ioutil.TempDir("", "collectstatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	manifest := `{"paths":{"css/style.css":"css/style.98718311206c.css","img/pix.png":"img/pix.3eaf17869bb5.png"},"version":3}`
+	err = ioutil.WriteFile(filepath.Join(outputDir, "staticfiles.json"), []byte(manifest), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(outputDir, "img"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(outputDir, "img/pix.3eaf17869bb5.png"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	code = run([]string{"-output", outputDir, "-verify"}, nil, &out)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "Missing files:\ncss/style.98718311206c.css\n", out.String())
+}
+
+// syncBuffer is the bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "collectstatic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	inputDir := filepath.Join(rootDir, "input")
+	outputDir := filepath.Join(rootDir, "output")
+	stylePath := filepath.Join(inputDir, "style.css")
+
+	err = os.MkdirAll(inputDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(stylePath, []byte("div {}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := staticfiles.NewStorage(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watchInterval = 10 * time.Millisecond
+	defer func() { watchInterval = 500 * time.Millisecond }()
+
+	var out syncBuffer
+	signals := make(chan os.Signal, 1)
+	code := make(chan int)
+	go func() {
+		code <- watch(storage, &out, signals)
+	}()
+
+	waitOutput := func(substr string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), substr) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Files are changed once the watcher is started
+	waitOutput("Watching for changes")
+
+	err = ioutil.WriteFile(stylePath, []byte("p {}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the change is visible on the file systems with the coarse timestamps
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(stylePath, future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitOutput("Rebuilt")
+
+	signals <- os.Interrupt
+	assert.Equal(t, 0, <-code)
+	assert.Contains(t, out.String(), "Watching for changes")
+	assert.Contains(t, out.String(), "Rebuilt 1 changed files: "+stylePath)
+	assert.Equal(t, "style.c3ee3d7a4380.css", storage.Resolve("style.css"))
+}
@@ -0,0 +1,253 @@
+package staticfiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GzipExt is the extension of the gzip-compressed copies of the storage files.
+const GzipExt string = ".gz"
+
+// GzipEncoding is the content encoding of the gzip-compressed copies, see Storage.CompressedSize.
+const GzipEncoding string = "gzip"
+
+// BrotliExt is the extension of the brotli-compressed copies of the storage files.
+const BrotliExt string = ".br"
+
+// BrotliEncoding is the content encoding of the brotli-compressed copies, see Storage.CompressedSize.
+const BrotliEncoding string = "br"
+
+// compressedExtensions lists the extensions of the compressed copies of the storage files.
+var compressedExtensions = []string{GzipExt, BrotliExt}
+
+// Encoder returns the writer compressing the data written to it to w.
+// Closing the writer must flush the compressed data, but not close w.
+// The standard library has no brotli encoder, so the Storage.Brotli
+// is set to a third-party one, e.g.:
+//
+//	storage.Brotli = func(w io.Writer) (io.WriteCloser, error) {
+//		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+//	}
+//
+// or to the CommandEncoder running the brotli command line tool.
+type Encoder func(w io.Writer) (io.WriteCloser, error)
+
+// CommandEncoder returns the Encoder piping the data through the external command
+// which reads it from stdin and writes the compressed data to stdout, e.g.
+// CommandEncoder("brotli", "--best", "--stdout").
+func CommandEncoder(name string, args ...string) Encoder {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdout = w
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandWriter{cmd: cmd, stdin: stdin, stderr: stderr}, nil
+	}
+}
+
+// commandWriter writes the data to the stdin of the running command.
+type commandWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *bytes.Buffer
+}
+
+func (w *commandWriter) Write(p []byte) (int, error) {
+	return w.stdin.Write(p)
+}
+
+// Close closes the command stdin and waits for the command to exit.
+func (w *commandWriter) Close() error {
+	err := w.stdin.Close()
+	if waitErr := w.cmd.Wait(); waitErr != nil {
+		err = fmt.Errorf("%s: %v: %s", w.cmd.Path, waitErr, strings.TrimSpace(w.stderr.String()))
+	}
+	return err
+}
+
+// isCompressedCopy reports whether the file is the compressed copy of the existing storage file.
+func isCompressedCopy(path string) bool {
+	for _, ext := range compressedExtensions {
+		if strings.HasSuffix(path, ext) {
+			_, err := os.Stat(strings.TrimSuffix(path, ext))
+			return err == nil
+		}
+	}
+	return false
+}
+
+// gzipEncoder is the Encoder writing gzip-compressed data with the best compression.
+func gzipEncoder(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+// DefaultIncompressibleExtensions lists extensions of the already compressed
+// file formats skipped when the storage files are compressed.
+var DefaultIncompressibleExtensions = []string{
+	".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".ico",
+	".woff", ".woff2",
+	".zip", ".gz", ".br", ".bz2", ".xz", ".7z", ".rar",
+	".mp3", ".mp4", ".ogg", ".webm",
+	".pdf",
+}
+
+// isCompressible reports whether the file extension is in the Storage.CompressibleExtensions
+// if it's not nil, or isn't in the Storage.IncompressibleExtensions or
+// the DefaultIncompressibleExtensions if the former is nil.
+func (s *Storage) isCompressible(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if s.CompressibleExtensions != nil {
+		for _, e := range s.CompressibleExtensions {
+			if strings.ToLower(e) == ext {
+				return true
+			}
+		}
+		return false
+	}
+
+	extensions := s.IncompressibleExtensions
+	if extensions == nil {
+		extensions = DefaultIncompressibleExtensions
+	}
+
+	for _, e := range extensions {
+		if strings.ToLower(e) == ext {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compressFiles writes gzip-compressed copies of the compressible storage files
+// next to them with the GzipExt extension added and the brotli-compressed ones
+// with the BrotliExt if the Storage.Brotli is set. The sizes of the storage files
+// and their copies are recorded.
+func (s *Storage) compressFiles() error {
+	for _, sf := range s.FilesMap {
+		if sf.Path == "" {
+			continue
+		}
+
+		stat, err := os.Stat(sf.StoragePath)
+		if err != nil {
+			return err
+		}
+
+		var compressedSizes map[string]int64
+		if s.isCompressible(sf.StoragePath) {
+			compressedSizes, err = s.compressFile(sf)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.filesLock.Lock()
+		sf.Size = stat.Size()
+		sf.CompressedSizes = compressedSizes
+		s.filesLock.Unlock()
+	}
+
+	return nil
+}
+
+// encoding is the content encoding of the compressed copies of the storage files.
+type encoding struct {
+	name    string // Content-Encoding header value
+	ext     string
+	encoder Encoder
+}
+
+// encodings returns the content encodings enabled with the Storage.Gzip and the Storage.Brotli.
+func (s *Storage) encodings() []encoding {
+	var encodings []encoding
+	if s.Gzip {
+		encodings = append(encodings, encoding{GzipEncoding, GzipExt, gzipEncoder})
+	}
+	if s.Brotli != nil {
+		encodings = append(encodings, encoding{BrotliEncoding, BrotliExt, s.Brotli})
+	}
+	return encodings
+}
+
+// compressFile writes the compressed copies of the storage file
+// and returns their sizes by the content encoding.
+func (s *Storage) compressFile(sf *StaticFile) (map[string]int64, error) {
+	if s.Verbose {
+		log.Printf("Compressing '%s'", sf.RelPath)
+	}
+
+	sizes := make(map[string]int64)
+	for _, encoding := range s.encodings() {
+		dst := sf.StoragePath + encoding.ext
+		err := encodeFile(sf.StoragePath, dst, encoding.encoder)
+		if err != nil {
+			return nil, err
+		}
+
+		stat, err := os.Stat(dst)
+		if err != nil {
+			return nil, err
+		}
+		sizes[encoding.name] = stat.Size()
+	}
+	return sizes, nil
+}
+
+// CompressedSize returns the size of the compressed copy of the file with
+// the original relative path in the content encoding, e.g. GzipEncoding or
+// BrotliEncoding, recorded when the Storage.Gzip or the Storage.Brotli is enabled.
+// It returns 0 for unknown paths and the files without such copy.
+func (s *Storage) CompressedSize(relPath, encoding string) int64 {
+	if sf, ok := s.findFile(relPath); ok {
+		return sf.CompressedSizes[encoding]
+	}
+	return 0
+}
+
+// encodeFile writes the src file content compressed with the encoder to the dst file.
+func encodeFile(src, dst string, encoder Encoder) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw, err := encoder(out)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
@@ -1,74 +1,737 @@
 package staticfiles
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"go/format"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Manifest file name. It will be stored in the Storage.OutputDir directory.
 const ManifestFilename string = "staticfiles.json"
-const ManifestVersion int = 1
+
+// Compressed manifest file name used when Storage.CompressManifest is enabled.
+const ManifestGzipFilename string = ManifestFilename + ".gz"
+const ManifestVersion int = 4
+
+// minManifestVersion is the oldest manifest version still supported.
+// Version 1 manifests lack the content types, version 2 ones lack
+// the modification times and version 3 ones lack the content hashes.
+const minManifestVersion int = 1
+
+// ChangeLog file name used when Storage.WriteChangeLog is enabled.
+// It will be stored in the Storage.OutputDir directory.
+const ChangeLogFilename string = "changes.json"
+
+// Manifest checksum file name used when Storage.ManifestChecksum is enabled.
+// It contains SHA-256 sum of the manifest file, i.e. the ManifestGzipFilename
+// with the Storage.CompressManifest, in the sha256sum format, so it can be
+// checked with "sha256sum -c".
+const ManifestChecksumFilename string = ManifestFilename + ".sha256"
 
 var ErrManifestVersionMismatch = errors.New("manifest version mismatch")
 
+// ErrManifestChecksumMismatch is returned when the manifest content doesn't match
+// its checksum or the checksum file is missing while Storage.ManifestChecksum is enabled.
+var ErrManifestChecksumMismatch = errors.New("manifest checksum mismatch")
+
+// ErrManifestNotRebuildable is returned by Storage.RebuildManifestFromOutput
+// when the original file names can't be restored from the storage file names.
+var ErrManifestNotRebuildable = errors.New("manifest can't be rebuilt from the output")
+
 // Manifest contains mapping of the original relative file paths
 // to the storage relative file paths.
 type ManifestScheme struct {
-	Paths   map[string]string `json:"paths"`
-	Version int               `json:"version"`
+	Paths          map[string]string    `json:"paths"`
+	PathPrefix     string               `json:"path_prefix,omitempty"`     // prefix prepended to the Paths values
+	VersionSegment string               `json:"version_segment,omitempty"` // see Storage.VersionSegment
+	CacheControl   map[string]string    `json:"cache_control,omitempty"`
+	Pinned         []string             `json:"pinned,omitempty"`
+	Hashes         map[string]string    `json:"hashes,omitempty"`         // query string hashes of the files in the Storage.QueryStringMode
+	ContentHashes  map[string]string    `json:"content_hashes,omitempty"` // see Storage.Hash
+	ContentTypes   map[string]string    `json:"content_types,omitempty"`  // see Storage.RecordContentType
+	Digests        map[string]string    `json:"digests,omitempty"`        // storage files content hashes, see Storage.VerifyOnOpen
+	ModTimes       map[string]time.Time `json:"mod_times,omitempty"`      // see Storage.RecordModTime
+	// Storage files sizes and their compressed copies sizes by the content encoding
+	Sizes           map[string]int64            `json:"sizes,omitempty"`
+	CompressedSizes map[string]map[string]int64 `json:"compressed_sizes,omitempty"`
+	Latest          map[string]string           `json:"latest,omitempty"` // see Storage.EmitLatestAlias
+	Version         int                         `json:"version"`
 }
 
-func saveManifest(dir string, filesMap map[string]*StaticFile) error {
-	manifestPath := filepath.Join(dir, ManifestFilename)
+func (s *Storage) marshalManifest() ([]byte, error) {
+	pathPrefix := s.ManifestPathPrefix
 	manifest := ManifestScheme{
-		Paths:   make(map[string]string),
-		Version: ManifestVersion,
+		Paths:           make(map[string]string),
+		PathPrefix:      pathPrefix,
+		VersionSegment:  s.versionSegment(),
+		CacheControl:    make(map[string]string),
+		Hashes:          make(map[string]string),
+		ContentHashes:   make(map[string]string),
+		ContentTypes:    make(map[string]string),
+		Digests:         make(map[string]string),
+		ModTimes:        make(map[string]time.Time),
+		Sizes:           make(map[string]int64),
+		CompressedSizes: make(map[string]map[string]int64),
+		Latest:          make(map[string]string),
+		Version:         ManifestVersion,
+	}
+
+	for _, sf := range s.FilesMap {
+		relPath := normalizeSlashes(sf.RelPath)
+		storageRelPath := pathPrefix + normalizeSlashes(sf.StorageRelPath)
+
+		if prev, ok := manifest.Paths[relPath]; ok {
+			if prev != storageRelPath {
+				return nil, newManifestKeyConflictError(relPath, prev, storageRelPath)
+			}
+			continue
+		}
+		manifest.Paths[relPath] = storageRelPath
+
+		if sf.CacheControl != "" {
+			manifest.CacheControl[relPath] = sf.CacheControl
+		}
+
+		if sf.Pinned {
+			manifest.Pinned = append(manifest.Pinned, relPath)
+		}
+
+		if sf.Hash != "" {
+			manifest.Hashes[relPath] = sf.Hash
+		}
+
+		if sf.ContentHash != "" {
+			manifest.ContentHashes[relPath] = sf.ContentHash
+		}
+
+		if sf.ContentType != "" {
+			manifest.ContentTypes[relPath] = sf.ContentType
+		}
+
+		if sf.Digest != "" {
+			manifest.Digests[relPath] = sf.Digest
+		}
+
+		if !sf.ModTime.IsZero() {
+			manifest.ModTimes[relPath] = sf.ModTime
+		}
+
+		if sf.Size > 0 {
+			manifest.Sizes[relPath] = sf.Size
+		}
+
+		if len(sf.CompressedSizes) > 0 {
+			manifest.CompressedSizes[relPath] = sf.CompressedSizes
+		}
+
+		if sf.LatestRelPath != "" {
+			manifest.Latest[relPath] = pathPrefix + normalizeSlashes(sf.LatestRelPath)
+		}
+	}
+	sort.Strings(manifest.Pinned)
+
+	if s.ManifestIndent == "" {
+		return json.Marshal(manifest)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", s.ManifestIndent)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func unmarshalManifest(data []byte) (map[string]*StaticFile, error) {
+	var manifest *ManifestScheme
+	filesMap := make(map[string]*StaticFile)
+
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return filesMap, err
+	}
+
+	if manifest.Version < minManifestVersion || manifest.Version > ManifestVersion {
+		return filesMap, ErrManifestVersionMismatch
+	}
+
+	for key, storageRelPath := range manifest.Paths {
+		relPath := normalizeSlashes(key)
+		storageRelPath = normalizeSlashes(strings.TrimPrefix(storageRelPath, manifest.PathPrefix))
+
+		// Keys differing only by the path separator are merged
+		if prev, ok := filesMap[relPath]; ok {
+			if prev.StorageRelPath != storageRelPath {
+				return make(map[string]*StaticFile), newManifestKeyConflictError(relPath, prev.StorageRelPath, storageRelPath)
+			}
+			continue
+		}
+
+		filesMap[relPath] = &StaticFile{
+			RelPath:         relPath,
+			StorageRelPath:  storageRelPath,
+			CacheControl:    manifest.CacheControl[key],
+			Hash:            manifest.Hashes[key],
+			ContentHash:     manifest.ContentHashes[key],
+			ContentType:     manifest.ContentTypes[key],
+			Digest:          manifest.Digests[key],
+			ModTime:         manifest.ModTimes[key],
+			Size:            manifest.Sizes[key],
+			CompressedSizes: manifest.CompressedSizes[key],
+			LatestRelPath:   normalizeSlashes(strings.TrimPrefix(manifest.Latest[key], manifest.PathPrefix)),
+		}
+	}
+
+	for _, relPath := range manifest.Pinned {
+		if sf, ok := filesMap[normalizeSlashes(relPath)]; ok {
+			sf.Pinned = true
+		}
+	}
+
+	return filesMap, nil
+}
+
+// normalizeSlashes replaces backslashes in the path with forward slashes
+// regardless of the platform, so the manifests are portable.
+func normalizeSlashes(path string) string {
+	return strings.Replace(path, "\\", "/", -1)
+}
+
+// ManifestKeyConflictError is returned when the manifest keys differing only
+// by the path separator point to the different storage files.
+type ManifestKeyConflictError struct {
+	Key     string
+	Targets [2]string // storage relative file paths
+}
+
+func newManifestKeyConflictError(key, target1, target2 string) *ManifestKeyConflictError {
+	targets := [2]string{target1, target2}
+	if targets[0] > targets[1] {
+		targets[0], targets[1] = targets[1], targets[0]
+	}
+	return &ManifestKeyConflictError{Key: key, Targets: targets}
+}
+
+func (e *ManifestKeyConflictError) Error() string {
+	return fmt.Sprintf("manifest key '%s' conflict: '%s' and '%s' differ", e.Key, e.Targets[0], e.Targets[1])
+}
+
+// isManifestFile reports whether the file is named like the manifest or its sidecar files,
+// so the manifests of the previous outputs aren't collected if found in the input directories.
+func isManifestFile(path string) bool {
+	switch filepath.Base(path) {
+	case ManifestFilename, ManifestGzipFilename, ManifestChecksumFilename:
+		return true
+	}
+	return false
+}
+
+// saveManifest writes the manifest to the dir with the Storage.OutputBackend.
+func (s *Storage) saveManifest(dir string) error {
+	manifestPath := filepath.Join(dir, ManifestFilename)
+	backend := s.outputBackend()
+
+	data, err := s.marshalManifest()
+	if err != nil {
+		return err
+	}
+
+	name := ManifestFilename
+	if s.CompressManifest {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(data); err != nil {
+			return err
+		}
+		if err = zw.Close(); err != nil {
+			return err
+		}
+		data, name = buf.Bytes(), ManifestGzipFilename
+	}
+
+	err = s.saveManifestChecksum(dir, name, data)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeOutput(filepath.Join(dir, name), bytes.NewReader(data), int64(len(data)))
+	if err != nil || !s.CompressManifest {
+		return err
+	}
+
+	// Remove the plain manifest left from the previous builds
+	// since it takes precedence over the compressed one
+	return backend.Delete(manifestPath)
+}
+
+// saveManifestChecksum writes the checksum file of the manifest file with the name
+// and the data or removes the one left from the previous builds if Storage.ManifestChecksum
+// is disabled.
+func (s *Storage) saveManifestChecksum(dir, name string, data []byte) error {
+	checksumPath := filepath.Join(dir, ManifestChecksumFilename)
+
+	if !s.ManifestChecksum {
+		return s.outputBackend().Delete(checksumPath)
+	}
+
+	sum := sha256.Sum256(data)
+	line := hex.EncodeToString(sum[:]) + "  " + name + "\n"
+
+	return s.writeOutput(checksumPath, strings.NewReader(line), int64(len(line)))
+}
+
+// verifyManifestChecksum checks the data of the manifest file with the name
+// against the checksum file in the dir. Missing checksum file is an error only
+// if the checksum is required. Checksum files written by the older versions
+// for the compressed manifests have the sum of the uncompressed data.
+func verifyManifestChecksum(dir, name string, data []byte, required bool) error {
+	line, err := ioutil.ReadFile(filepath.Join(dir, ManifestChecksumFilename))
+	if os.IsNotExist(err) {
+		if required {
+			return ErrManifestChecksumMismatch
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) > 1 && name == ManifestGzipFilename && fields[1] == ManifestFilename {
+		data, err = gunzip(data)
+		if err != nil {
+			return err
+		}
+		name = ManifestFilename
+	}
+
+	sum := sha256.Sum256(data)
+	if len(fields) == 0 || fields[0] != hex.EncodeToString(sum[:]) ||
+		(len(fields) > 1 && strings.TrimPrefix(fields[1], "*") != name) {
+		return ErrManifestChecksumMismatch
 	}
 
-	for _, sf := range filesMap {
-		manifest.Paths[sf.RelPath] = sf.StorageRelPath
+	return nil
+}
+
+// loadManifest reads the plain manifest from the dir
+// or the compressed one if the plain manifest doesn't exist.
+// The manifest is verified against the checksum file if it exists
+// or requireChecksum is set.
+func loadManifest(dir string, requireChecksum bool) (map[string]*StaticFile, error) {
+	name := ManifestFilename
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		gzData, gzErr := ioutil.ReadFile(filepath.Join(dir, ManifestGzipFilename))
+		if !os.IsNotExist(gzErr) {
+			name, data, err = ManifestGzipFilename, gzData, gzErr
+		}
 	}
+	if err != nil {
+		return make(map[string]*StaticFile), err
+	}
+
+	err = verifyManifestChecksum(dir, name, data, requireChecksum)
+	if err != nil {
+		return make(map[string]*StaticFile), err
+	}
+
+	if name == ManifestGzipFilename {
+		data, err = gunzip(data)
+		if err != nil {
+			return make(map[string]*StaticFile), err
+		}
+	}
+
+	return unmarshalManifest(data)
+}
+
+// LoadManifest reloads the Storage.FilesMap from the manifest in the Storage.OutputDir.
+// Unlike NewStorage, it requires the manifest checksum when Storage.ManifestChecksum is enabled.
+func (s *Storage) LoadManifest() error {
+	return s.applyManifest(loadManifest(s.OutputDir, s.ManifestChecksum))
+}
+
+// LoadManifestFrom reloads the Storage.FilesMap from the manifest file with the path,
+// e.g. a known-good snapshot kept outside of the Storage.OutputDir, to pin the resolution
+// to it. The manifest is read as gzip-compressed if the path has the GzipExt extension.
+func (s *Storage) LoadManifestFrom(path string) error {
+	return s.applyManifest(readManifestFile(path))
+}
 
-	data, err := json.Marshal(manifest)
+// applyManifest replaces the Storage.FilesMap with the loaded one unless loading
+// has failed. On the version mismatch with the VersionMismatchRebuild policy
+// the Storage.FilesMap is emptied instead.
+func (s *Storage) applyManifest(filesMap map[string]*StaticFile, err error) error {
+	if err == ErrManifestVersionMismatch && s.OnVersionMismatch == VersionMismatchRebuild {
+		filesMap, err = make(map[string]*StaticFile), nil
+	}
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(manifestPath, data, 0644)
+	s.buildLock.Lock()
+	s.setFilesMap(filesMap)
+	s.buildLock.Unlock()
+	return nil
+}
+
+func readGzipFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return gunzip(data)
+}
+
+// gunzip returns the uncompressed gzip data.
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return ioutil.ReadAll(zr)
+}
+
+// WriteManifest writes the current Storage.FilesMap in the manifest format to w.
+func (s *Storage) WriteManifest(w io.Writer) error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	data, err := s.marshalManifest()
 	if err != nil {
 		return err
 	}
 
+	_, err = w.Write(data)
 	return err
 }
 
-func loadManifest(dir string) (map[string]*StaticFile, error) {
-	var manifest *ManifestScheme
-	filesMap := make(map[string]*StaticFile)
-	manifestPath := filepath.Join(dir, ManifestFilename)
+// ReadManifest reads the manifest from r and replaces the Storage.FilesMap with its content.
+func (s *Storage) ReadManifest(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return s.applyManifest(unmarshalManifest(data))
+}
+
+// ManifestStatusError is returned by Storage.LoadManifestURL when
+// the server responds with the status other than 200 OK.
+type ManifestStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *ManifestStatusError) Error() string {
+	return fmt.Sprintf("manifest %s: unexpected status %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// LoadManifestURL fetches the manifest from the URL with the client, e.g. the manifest
+// of the sibling static server, and replaces the Storage.FilesMap with its content.
+// The http.DefaultClient is used if the client is nil. ManifestStatusError is returned
+// for the responses other than 200 OK. The manifest version is checked like
+// with LoadManifest according to the Storage.OnVersionMismatch.
+func (s *Storage) LoadManifestURL(url string, client *http.Client) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
 
-	data, err := ioutil.ReadFile(manifestPath)
+	resp, err := client.Get(url)
 	if err != nil {
-		return filesMap, err
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &ManifestStatusError{URL: url, StatusCode: resp.StatusCode}
 	}
 
-	err = json.Unmarshal(data, &manifest)
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return filesMap, err
+		return err
 	}
 
-	if manifest.Version != ManifestVersion {
-		return filesMap, ErrManifestVersionMismatch
+	return s.applyManifest(unmarshalManifest(data))
+}
+
+// GenerateGoManifest writes a Go source file to the outPath declaring
+// the varName variable of type map[string]string in the packageName package.
+// The map contains the current Storage.FilesMap mapping of the original
+// relative file paths to the storage relative file paths.
+func (s *Storage) GenerateGoManifest(packageName, varName, outPath string) error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	relPaths := make([]string, 0, len(s.FilesMap))
+	for relPath := range s.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by staticfiles. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", packageName)
+	fmt.Fprintf(&buf, "var %s = map[string]string{\n", varName)
+	for _, relPath := range relPaths {
+		fmt.Fprintf(&buf, "%q: %q,\n", relPath, s.FilesMap[relPath].resolvedPath())
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	data, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(outPath, data, 0644)
+}
+
+// DiffManifests compares the manifest files and returns sorted lists of
+// the original relative file paths added to, changed in and removed from
+// the new manifest comparing to the old one. A path is changed if its storage
+// path differs. Files with the GzipExt extension are read as compressed manifests.
+func DiffManifests(oldPath, newPath string) (added, changed, removed []string, err error) {
+	oldFilesMap, err := readManifestFile(oldPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	newFilesMap, err := readManifestFile(newPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	added, changed, removed = diffResolvedPaths(resolvedPaths(oldFilesMap), resolvedPaths(newFilesMap))
+	return added, changed, removed, nil
+}
+
+// resolvedPaths maps the original relative file paths to the resolved storage paths.
+func resolvedPaths(filesMap map[string]*StaticFile) map[string]string {
+	paths := make(map[string]string, len(filesMap))
+	for relPath, sf := range filesMap {
+		paths[relPath] = sf.resolvedPath()
+	}
+	return paths
+}
+
+// diffResolvedPaths returns sorted lists of the original relative file paths
+// added, changed and removed in the new resolved paths comparing to the old ones.
+func diffResolvedPaths(oldPaths, newPaths map[string]string) (added, changed, removed []string) {
+	for relPath, newPath := range newPaths {
+		if oldPath, ok := oldPaths[relPath]; !ok {
+			added = append(added, relPath)
+		} else if oldPath != newPath {
+			changed = append(changed, relPath)
+		}
+	}
+
+	for relPath := range oldPaths {
+		if _, ok := newPaths[relPath]; !ok {
+			removed = append(removed, relPath)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	return added, changed, removed
+}
+
+// ChangeLog lists the original relative paths of the files added, changed
+// and removed by the collection, see Storage.WriteChangeLog.
+type ChangeLog struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// saveChangeLog writes the ChangeLogFilename to the Storage.OutputDir with the changes
+// of the Storage.FilesMap comparing to the resolved paths before the collection.
+func (s *Storage) saveChangeLog(prevPaths map[string]string) error {
+	added, changed, removed := diffResolvedPaths(prevPaths, resolvedPaths(s.FilesMap))
+	changeLog := ChangeLog{
+		Added:   append([]string{}, added...),
+		Changed: append([]string{}, changed...),
+		Removed: append([]string{}, removed...),
+	}
+
+	data, err := json.Marshal(changeLog)
+	if err != nil {
+		return err
+	}
+
+	return s.writeOutput(filepath.Join(s.OutputDir, ChangeLogFilename), bytes.NewReader(data), int64(len(data)))
+}
+
+func readManifestFile(path string) (map[string]*StaticFile, error) {
+	var data []byte
+	var err error
+
+	if strings.HasSuffix(path, GzipExt) {
+		data, err = readGzipFile(path)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalManifest(data)
+}
+
+// hashedNameRegex returns the regular expression matching the storage file names
+// with the hash sum in the Storage.HashEncoding inserted before the extension,
+// including the compound ones.
+// Hash sums extended to avoid collisions are matched as well.
+func (s *Storage) hashedNameRegex() *regexp.Regexp {
+	alphabet := "0-9a-f"
+	switch s.HashEncoding {
+	case Base32:
+		alphabet = "a-z2-7"
+	case Base62:
+		alphabet = "0-9a-zA-Z"
+	}
+	hashPattern := fmt.Sprintf("[%s]{%d,}", alphabet, s.hashChars())
+
+	extPattern := `\.[^.]*`
+	for _, ext := range s.compoundExtensions() {
+		extPattern = regexp.QuoteMeta(ext) + "|" + extPattern
+	}
+
+	return regexp.MustCompile(`^(?P<prefix>.*)\.(?P<hash>` + hashPattern + `)(?P<ext>(?i:` + extPattern + `))?$`)
+}
+
+// RebuildManifestFromOutput regenerates the Storage.FilesMap and the manifest
+// from the files already present in the Storage.OutputDir, e.g. restored from a cache,
+// without collecting them again. The original file names are restored by stripping
+// the hash sum from the storage file names or kept as is with the Storage.VersionSegment.
+// In the Storage.QueryStringMode the hash sums are computed from the storage files content.
+// When several storage files have the same original name, the last modified one wins.
+// The manifest files, the ChangeLogFilename and the LatestDir in the Storage.OutputDir
+// are skipped. The Storage.ContentAddressed names can't be reversed, so ErrManifestNotRebuildable
+// is returned in this mode.
+func (s *Storage) RebuildManifestFromOutput() error {
+	if s.ContentAddressed {
+		return ErrManifestNotRebuildable
+	}
+
+	pinnedNames := make(map[string]string, len(s.pins))
+	for relPath, name := range s.pins {
+		pinnedNames[path.Join(path.Dir(relPath), name)] = relPath
 	}
 
-	for relPath, storageRelPath := range manifest.Paths {
+	s.buildLock.Lock()
+	defer s.buildLock.Unlock()
+
+	err := s.updateVersion()
+	if err != nil {
+		return err
+	}
+
+	hashed := s.versionSegment() == "" && !s.QueryStringMode
+	regex := s.hashedNameRegex()
+	rootDir := filepath.Join(s.OutputDir, s.versionSegment())
+	filesMap := make(map[string]*StaticFile)
+	modTimes := make(map[string]time.Time)
+
+	err = filepath.Walk(rootDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		filePath = filepath.ToSlash(filePath)
+		storageRelPath := strings.TrimPrefix(filePath, s.OutputDir)
+		name := filepath.Base(filePath)
+
+		if info.IsDir() {
+			// Copies written with the Storage.EmitLatestAlias
+			if storageRelPath == LatestDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case strings.HasPrefix(name, ".staticfiles-"):
+			// Temporary file left by the interrupted collection
+			return nil
+		case (isManifestFile(name) || name == ChangeLogFilename) && storageRelPath == name:
+			// Storage metadata files
+			return nil
+		case isCompressedCopy(filePath):
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(filePath, filepath.ToSlash(rootDir)+"/")
+		pinnedRelPath, pinned := pinnedNames[relPath]
+		if pinned {
+			relPath = pinnedRelPath
+		} else if hashed {
+			if !regex.MatchString(name) {
+				return nil
+			}
+			name = findSubmatchGroup(regex, name, "prefix") + findSubmatchGroup(regex, name, "ext")
+			relPath = path.Join(path.Dir(relPath), name)
+		}
+
+		if modTime, ok := modTimes[relPath]; ok && modTime.After(info.ModTime()) {
+			return nil
+		}
+		modTimes[relPath] = info.ModTime()
+
+		var hashSum string
+		if s.QueryStringMode && !pinned {
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			hashSum, err = s.hashReader(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		var contentType string
+		if s.RecordContentType {
+			contentType, err = detectContentType(filePath)
+			if err != nil {
+				return err
+			}
+		}
+
 		filesMap[relPath] = &StaticFile{
 			RelPath:        relPath,
+			StoragePath:    filePath,
 			StorageRelPath: storageRelPath,
+			CacheControl:   s.matchCachePolicy(relPath),
+			Pinned:         pinned,
+			Hash:           hashSum,
+			ContentType:    contentType,
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return filesMap, nil
+	s.setFilesMap(filesMap)
+	return s.saveManifest(s.OutputDir)
 }
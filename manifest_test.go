@@ -1,10 +1,19 @@
 package staticfiles
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/stretchr/testify/suite"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -30,10 +39,12 @@ func (s *ManifestTestSuite) SetupTest() {
 
 func (s *ManifestTestSuite) TearDownTest() {
 	os.Remove(s.ManifestPath)
+	os.Remove(filepath.Join(s.StoragePath, ManifestGzipFilename))
+	os.Remove(filepath.Join(s.StoragePath, ManifestChecksumFilename))
 }
 
 func (s *ManifestTestSuite) TestManifestNotExist() {
-	_, err := loadManifest(s.StoragePath)
+	_, err := loadManifest(s.StoragePath, false)
 	s.Assert().True(os.IsNotExist(err))
 }
 
@@ -41,15 +52,88 @@ func (s *ManifestTestSuite) TestManifestVersionMismatch() {
 	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{},"version":0}`), 0644)
 	s.Require().NoError(err)
 
-	_, err = loadManifest(s.StoragePath)
+	_, err = loadManifest(s.StoragePath, false)
 	s.Assert().Equal(ErrManifestVersionMismatch, err)
+
+	err = ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{},"version":5}`), 0644)
+	s.Require().NoError(err)
+
+	_, err = loadManifest(s.StoragePath, false)
+	s.Assert().Equal(ErrManifestVersionMismatch, err)
+}
+
+func (s *ManifestTestSuite) TestLoadManifest_OnVersionMismatch() {
+	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{"style.css":"style.5f15d96d5cdb.css"},"version":0}`), 0644)
+	s.Require().NoError(err)
+
+	staleFilesMap := map[string]*StaticFile{
+		"style.css": {RelPath: "style.css", StorageRelPath: "style.3814b2f7b190.css"},
+	}
+
+	storage := &Storage{OutputDir: s.StoragePath, FilesMap: staleFilesMap}
+	s.Assert().Equal(ErrManifestVersionMismatch, storage.LoadManifest())
+	s.Assert().Equal(staleFilesMap, storage.FilesMap)
+
+	storage.OnVersionMismatch = VersionMismatchRebuild
+	s.Require().NoError(storage.LoadManifest())
+	s.Assert().Empty(storage.FilesMap)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	_, err = loadManifest(s.StoragePath, false)
+	s.Assert().NoError(err)
+}
+
+func (s *ManifestTestSuite) TestLoadManifest_BackslashKeys() {
+	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{"css\\style.css":"css\\style.5f15d96d5cdb.css","css/style.css":"css/style.5f15d96d5cdb.css","img\\pix.png":"img/pix.3eaf17869bb5.png"},"cache_control":{"img\\pix.png":"no-cache"},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	filesMap, err := loadManifest(s.StoragePath, false)
+	s.Require().NoError(err)
+	s.Assert().Equal(map[string]*StaticFile{
+		"css/style.css": {
+			RelPath:        "css/style.css",
+			StorageRelPath: "css/style.5f15d96d5cdb.css",
+		},
+		"img/pix.png": {
+			RelPath:        "img/pix.png",
+			StorageRelPath: "img/pix.3eaf17869bb5.png",
+			CacheControl:   "no-cache",
+		},
+	}, filesMap)
+
+	// Duplicate keys with different targets
+	err = ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{"css\\style.css":"css/style.5f15d96d5cdb.css","css/style.css":"css/style.98718311206c.css"},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	_, err = loadManifest(s.StoragePath, false)
+	s.Assert().Equal(&ManifestKeyConflictError{
+		Key:     "css/style.css",
+		Targets: [2]string{"css/style.5f15d96d5cdb.css", "css/style.98718311206c.css"},
+	}, err)
+}
+
+func (s *ManifestTestSuite) TestSaveManifest_BackslashKeys() {
+	storage := &Storage{
+		FilesMap: map[string]*StaticFile{
+			"css\\style.css": {
+				RelPath:        "css\\style.css",
+				StorageRelPath: "css\\style.5f15d96d5cdb.css",
+			},
+		},
+	}
+
+	data, err := storage.marshalManifest()
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"paths":{"css/style.css":"css/style.5f15d96d5cdb.css"},"version":4}`, string(data))
 }
 
 func (s *ManifestTestSuite) TestLoadManifest() {
 	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{"style.css":"style.5f15d96d5cdb4d0d5eb6901181826a04.css","pix.png":"pix.3eaf17869bb51bf27bd7c91bc9853973.png"},"version":1}`), 0644)
 	s.Require().NoError(err)
 
-	filesMap, err := loadManifest(s.StoragePath)
+	filesMap, err := loadManifest(s.StoragePath, false)
 	s.Require().NoError(err)
 
 	manifestFilesMap := map[string]*StaticFile{
@@ -64,3 +148,356 @@ func (s *ManifestTestSuite) TestLoadManifest() {
 	}
 	s.Assert().Equal(manifestFilesMap, filesMap)
 }
+
+func (s *ManifestTestSuite) TestManifestContentHash() {
+	storage := &Storage{
+		FilesMap: map[string]*StaticFile{
+			"css/style.css": {
+				RelPath:        "css/style.css",
+				StorageRelPath: "css/style.98718311206c.css",
+				ContentHash:    "98718311206ce188bf7260e1d0bbbcea",
+			},
+		},
+	}
+
+	data, err := storage.marshalManifest()
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"paths":{"css/style.css":"css/style.98718311206c.css"},"content_hashes":{"css/style.css":"98718311206ce188bf7260e1d0bbbcea"},"version":4}`, string(data))
+
+	filesMap, err := unmarshalManifest(data)
+	s.Require().NoError(err)
+	s.Assert().Equal(storage.FilesMap, filesMap)
+
+	// Older manifests have no content hashes
+	filesMap, err = unmarshalManifest([]byte(`{"paths":{"css/style.css":"css/style.98718311206c.css"},"version":3}`))
+	s.Require().NoError(err)
+	s.Assert().Equal("", filesMap["css/style.css"].ContentHash)
+}
+
+func (s *ManifestTestSuite) TestCompressedManifest() {
+	filesMap := map[string]*StaticFile{
+		"style.css": {
+			RelPath:        "style.css",
+			StorageRelPath: "style.5f15d96d5cdb.css",
+		},
+	}
+
+	// Stale plain manifest is replaced with the compressed one
+	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	storage := &Storage{FilesMap: filesMap, CompressManifest: true}
+	err = storage.saveManifest(s.StoragePath)
+	s.Require().NoError(err)
+
+	_, err = os.Stat(s.ManifestPath)
+	s.Assert().True(os.IsNotExist(err))
+
+	loadedFilesMap, err := loadManifest(s.StoragePath, false)
+	s.Require().NoError(err)
+	s.Assert().Equal(filesMap, loadedFilesMap)
+}
+
+func (s *ManifestTestSuite) TestManifestPathPrefix() {
+	storage := &Storage{
+		FilesMap: map[string]*StaticFile{
+			"css/style.css": {
+				RelPath:        "css/style.css",
+				StorageRelPath: "css/style.5f15d96d5cdb.css",
+			},
+		},
+		ManifestPathPrefix: "static/",
+	}
+
+	err := storage.saveManifest(s.StoragePath)
+	s.Require().NoError(err)
+
+	data, err := ioutil.ReadFile(s.ManifestPath)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"paths":{"css/style.css":"static/css/style.5f15d96d5cdb.css"},"path_prefix":"static/","version":4}`, string(data))
+
+	loaded, err := NewStorage(s.StoragePath)
+	s.Require().NoError(err)
+	s.Assert().Equal("css/style.5f15d96d5cdb.css", loaded.Resolve("css/style.css"))
+}
+
+func (s *ManifestTestSuite) TestManifestIndent() {
+	storage := &Storage{
+		FilesMap: map[string]*StaticFile{
+			"img/pix.png": {
+				RelPath:        "img/pix.png",
+				StorageRelPath: "img/pix.3eaf17869bb5.png",
+			},
+			"css/style.css": {
+				RelPath:        "css/style.css",
+				StorageRelPath: "css/style.5f15d96d5cdb.css",
+			},
+		},
+		ManifestIndent: "  ",
+	}
+
+	err := storage.saveManifest(s.StoragePath)
+	s.Require().NoError(err)
+
+	data, err := ioutil.ReadFile(s.ManifestPath)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{
+  "paths": {
+    "css/style.css": "css/style.5f15d96d5cdb.css",
+    "img/pix.png": "img/pix.3eaf17869bb5.png"
+  },
+  "version": 4
+}
+`, string(data))
+
+	loaded, err := NewStorage(s.StoragePath)
+	s.Require().NoError(err)
+	s.Assert().Equal("img/pix.3eaf17869bb5.png", loaded.Resolve("img/pix.png"))
+}
+
+func (s *ManifestTestSuite) TestManifestChecksum() {
+	storage := &Storage{
+		OutputDir: s.StoragePath,
+		FilesMap: map[string]*StaticFile{
+			"style.css": {
+				RelPath:        "style.css",
+				StorageRelPath: "style.5f15d96d5cdb.css",
+			},
+		},
+		ManifestChecksum: true,
+	}
+
+	err := storage.saveManifest(s.StoragePath)
+	s.Require().NoError(err)
+
+	loaded := &Storage{OutputDir: s.StoragePath, ManifestChecksum: true}
+	err = loaded.LoadManifest()
+	s.Require().NoError(err)
+	s.Assert().Equal(storage.FilesMap, loaded.FilesMap)
+
+	// Tampered manifest
+	err = ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{"style.css":"evil.css"},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	err = loaded.LoadManifest()
+	s.Assert().Equal(ErrManifestChecksumMismatch, err)
+
+	_, err = NewStorage(s.StoragePath)
+	s.Assert().Equal(ErrManifestChecksumMismatch, err)
+}
+
+func (s *ManifestTestSuite) TestManifestChecksum_Compressed() {
+	storage := &Storage{
+		OutputDir: s.StoragePath,
+		FilesMap: map[string]*StaticFile{
+			"style.css": {
+				RelPath:        "style.css",
+				StorageRelPath: "style.5f15d96d5cdb.css",
+			},
+		},
+		ManifestChecksum: true,
+		CompressManifest: true,
+	}
+
+	err := storage.saveManifest(s.StoragePath)
+	s.Require().NoError(err)
+
+	// Checksum line names the file written, so it can be checked with "sha256sum -c"
+	gzData, err := ioutil.ReadFile(filepath.Join(s.StoragePath, ManifestGzipFilename))
+	s.Require().NoError(err)
+	line, err := ioutil.ReadFile(filepath.Join(s.StoragePath, ManifestChecksumFilename))
+	s.Require().NoError(err)
+
+	sum := sha256.Sum256(gzData)
+	s.Assert().Equal(hex.EncodeToString(sum[:])+"  "+ManifestGzipFilename+"\n", string(line))
+
+	loaded := &Storage{OutputDir: s.StoragePath, ManifestChecksum: true}
+	err = loaded.LoadManifest()
+	s.Require().NoError(err)
+	s.Assert().Equal(storage.FilesMap, loaded.FilesMap)
+
+	// Older checksum files have the sum of the uncompressed manifest
+	data, err := storage.marshalManifest()
+	s.Require().NoError(err)
+	sum = sha256.Sum256(data)
+	err = ioutil.WriteFile(filepath.Join(s.StoragePath, ManifestChecksumFilename), []byte(hex.EncodeToString(sum[:])+"  "+ManifestFilename+"\n"), 0644)
+	s.Require().NoError(err)
+	s.Assert().NoError(loaded.LoadManifest())
+
+	// Checksum of the other file
+	sum = sha256.Sum256(gzData)
+	err = ioutil.WriteFile(filepath.Join(s.StoragePath, ManifestChecksumFilename), []byte(hex.EncodeToString(sum[:])+"  "+ManifestFilename+"\n"), 0644)
+	s.Require().NoError(err)
+	s.Assert().Equal(ErrManifestChecksumMismatch, loaded.LoadManifest())
+}
+
+func (s *ManifestTestSuite) TestManifestChecksum_Missing() {
+	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	storage := &Storage{OutputDir: s.StoragePath}
+	s.Assert().NoError(storage.LoadManifest())
+
+	storage.ManifestChecksum = true
+	s.Assert().Equal(ErrManifestChecksumMismatch, storage.LoadManifest())
+}
+
+func (s *ManifestTestSuite) TestGenerateGoManifest() {
+	outPath := filepath.Join(s.StoragePath, "staticfiles_manifest.go")
+	defer os.Remove(outPath)
+
+	storage := &Storage{
+		FilesMap: map[string]*StaticFile{
+			"style.css": {
+				RelPath:        "style.css",
+				StorageRelPath: "style.5f15d96d5cdb.css",
+			},
+			"img/pix.png": {
+				RelPath:        "img/pix.png",
+				StorageRelPath: "img/pix.3eaf17869bb5.png",
+			},
+		},
+	}
+
+	err := storage.GenerateGoManifest("assets", "Manifest", outPath)
+	s.Require().NoError(err)
+
+	f, err := parser.ParseFile(token.NewFileSet(), outPath, nil, 0)
+	s.Require().NoError(err)
+	s.Equal("assets", f.Name.Name)
+
+	obj := f.Scope.Lookup("Manifest")
+	s.Require().NotNil(obj)
+
+	spec := obj.Decl.(*ast.ValueSpec)
+	lit := spec.Values[0].(*ast.CompositeLit)
+
+	entries := make(map[string]string)
+	for _, elt := range lit.Elts {
+		kv := elt.(*ast.KeyValueExpr)
+		entries[kv.Key.(*ast.BasicLit).Value] = kv.Value.(*ast.BasicLit).Value
+	}
+
+	s.Equal(map[string]string{
+		`"style.css"`:   `"style.5f15d96d5cdb.css"`,
+		`"img/pix.png"`: `"img/pix.3eaf17869bb5.png"`,
+	}, entries)
+}
+
+func (s *ManifestTestSuite) TestLoadManifestFrom() {
+	err := ioutil.WriteFile(s.ManifestPath, []byte(`{"paths":{"style.css":"style.98718311206c.css"},"version":3}`), 0644)
+	s.Require().NoError(err)
+
+	// Snapshot kept outside of the output directory under a custom name
+	snapshotPath := filepath.Join(s.StoragePath, "staticfiles.blue.json")
+	err = ioutil.WriteFile(snapshotPath, []byte(`{"paths":{"style.css":"style.5f15d96d5cdb.css"},"version":3}`), 0644)
+	s.Require().NoError(err)
+	defer os.Remove(snapshotPath)
+
+	storage, err := NewStorage(s.StoragePath)
+	s.Require().NoError(err)
+	s.Assert().Equal("style.98718311206c.css", storage.Resolve("style.css"))
+
+	err = storage.LoadManifestFrom(snapshotPath)
+	s.Require().NoError(err)
+	s.Assert().Equal("style.5f15d96d5cdb.css", storage.Resolve("style.css"))
+
+	// Failed loading keeps the current files
+	err = storage.LoadManifestFrom(filepath.Join(s.StoragePath, "missing.json"))
+	s.Assert().True(os.IsNotExist(err))
+	s.Assert().Equal("style.5f15d96d5cdb.css", storage.Resolve("style.css"))
+}
+
+func (s *ManifestTestSuite) TestWriteReadManifest() {
+	storage := &Storage{
+		FilesMap: map[string]*StaticFile{
+			"style.css": {
+				RelPath:        "style.css",
+				StorageRelPath: "style.5f15d96d5cdb.css",
+			},
+			"sw.js": {
+				RelPath:        "sw.js",
+				StorageRelPath: "sw.3814b2f7b190.js",
+				CacheControl:   "no-cache",
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := storage.WriteManifest(&buf)
+	s.Require().NoError(err)
+
+	restored := &Storage{}
+	err = restored.ReadManifest(&buf)
+	s.Require().NoError(err)
+	s.Assert().Equal(storage.FilesMap, restored.FilesMap)
+}
+
+func (s *ManifestTestSuite) TestReadManifest_VersionMismatch() {
+	storage := &Storage{}
+	err := storage.ReadManifest(strings.NewReader(`{"paths":{},"version":0}`))
+	s.Assert().Equal(ErrManifestVersionMismatch, err)
+
+	storage.OnVersionMismatch = VersionMismatchRebuild
+	err = storage.ReadManifest(strings.NewReader(`{"paths":{},"version":0}`))
+	s.Assert().NoError(err)
+}
+
+func (s *ManifestTestSuite) TestLoadManifestURL() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/static/staticfiles.json":
+			w.Write([]byte(`{"paths":{"css/style.css":"css/style.5f15d96d5cdb.css"},"version":3}`))
+		case "/static/old.json":
+			w.Write([]byte(`{"paths":{},"version":0}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	storage := &Storage{Enabled: true}
+	err := storage.LoadManifestURL(server.URL+"/static/staticfiles.json", nil)
+	s.Require().NoError(err)
+	s.Assert().Equal("css/style.5f15d96d5cdb.css", storage.Resolve("css/style.css"))
+
+	err = storage.LoadManifestURL(server.URL+"/static/old.json", server.Client())
+	s.Assert().Equal(ErrManifestVersionMismatch, err)
+
+	err = storage.LoadManifestURL(server.URL+"/static/missing.json", server.Client())
+	s.Require().Error(err)
+	statusErr, ok := err.(*ManifestStatusError)
+	s.Require().True(ok, "Unexpected error type %T", err)
+	s.Assert().Equal(http.StatusNotFound, statusErr.StatusCode)
+
+	// Storage is kept intact on errors
+	s.Assert().Equal("css/style.5f15d96d5cdb.css", storage.Resolve("css/style.css"))
+}
+
+func (s *ManifestTestSuite) TestDiffManifests() {
+	oldPath := filepath.Join(s.StoragePath, "staticfiles.old.json")
+	newPath := filepath.Join(s.StoragePath, "staticfiles.new.json")
+	defer os.Remove(oldPath)
+	defer os.Remove(newPath)
+
+	err := ioutil.WriteFile(oldPath, []byte(`{"paths":{"same.css":"same.1.css","changed.css":"changed.1.css","removed.css":"removed.1.css"},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	err = ioutil.WriteFile(newPath, []byte(`{"paths":{"same.css":"same.1.css","changed.css":"changed.2.css","added.css":"added.1.css"},"version":1}`), 0644)
+	s.Require().NoError(err)
+
+	added, changed, removed, err := DiffManifests(oldPath, newPath)
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"added.css"}, added)
+	s.Assert().Equal([]string{"changed.css"}, changed)
+	s.Assert().Equal([]string{"removed.css"}, removed)
+
+	added, changed, removed, err = DiffManifests(oldPath, oldPath)
+	s.Require().NoError(err)
+	s.Assert().Empty(added)
+	s.Assert().Empty(changed)
+	s.Assert().Empty(removed)
+
+	_, _, _, err = DiffManifests(oldPath, filepath.Join(s.StoragePath, "not-exist.json"))
+	s.Assert().True(os.IsNotExist(err))
+}
@@ -0,0 +1,140 @@
+package staticfiles
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RewriteMiddleware returns http.Handler replacing the original relative file paths
+// with the storage relative file paths in the text/html responses of the next handler.
+// Paths are matched as a whole, e.g. "css/style.css" in "/static/css/style.css"
+// is replaced, but in "/static/css/mystyle.css" is not. Other responses as well as
+// compressed ones are passed through untouched. Nothing is replaced when the storage is disabled.
+func (s *Storage) RewriteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &rewriteResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		if !rw.decided {
+			if rw.status != 0 {
+				w.WriteHeader(rw.status)
+			}
+			return
+		}
+
+		if rw.html {
+			content := s.rewriteHTML(rw.buf.Bytes())
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(rw.status)
+			w.Write(content)
+		}
+	})
+}
+
+// rewriteHTML replaces the Storage.FilesMap keys found in the content
+// with the corresponding storage relative file paths.
+func (s *Storage) rewriteHTML(content []byte) []byte {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	if len(s.FilesMap) == 0 {
+		return content
+	}
+
+	s.indexLock.Lock()
+	if s.rewriteRegex == nil {
+		relPaths := make([]string, 0, len(s.FilesMap))
+		for relPath := range s.FilesMap {
+			relPaths = append(relPaths, regexp.QuoteMeta(relPath))
+		}
+
+		// Prefer the longest path when several paths match at the same position
+		sort.Slice(relPaths, func(i, j int) bool {
+			return len(relPaths[i]) > len(relPaths[j])
+		})
+		s.rewriteRegex = regexp.MustCompile(strings.Join(relPaths, "|"))
+	}
+	rewriteRegex := s.rewriteRegex
+	s.indexLock.Unlock()
+
+	var buf bytes.Buffer
+	last := 0
+
+	for _, loc := range rewriteRegex.FindAllIndex(content, -1) {
+		start, end := loc[0], loc[1]
+		if (start > 0 && isPathChar(content[start-1])) || (end < len(content) && isPathChar(content[end])) {
+			continue
+		}
+
+		buf.Write(content[last:start])
+		buf.WriteString(s.servedPath(s.FilesMap[string(content[start:end])]))
+		last = end
+	}
+	buf.Write(content[last:])
+
+	return buf.Bytes()
+}
+
+func isPathChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+// rewriteResponseWriter buffers text/html responses and passes through the other ones.
+type rewriteResponseWriter struct {
+	http.ResponseWriter
+	buf     bytes.Buffer
+	status  int
+	decided bool // whether the response type is determined
+	html    bool
+}
+
+func (w *rewriteResponseWriter) decide(p []byte) {
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(p)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	w.html = mediaType == "text/html" && w.Header().Get("Content-Encoding") == ""
+	w.decided = true
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if !w.html {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *rewriteResponseWriter) WriteHeader(status int) {
+	if w.decided {
+		return
+	}
+
+	w.status = status
+	if w.Header().Get("Content-Type") != "" {
+		w.decide(nil)
+	}
+}
+
+func (w *rewriteResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.decide(p)
+	}
+
+	if w.html {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
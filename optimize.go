@@ -0,0 +1,56 @@
+package staticfiles
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// ImageOptimizer returns the losslessly optimized content of the image,
+// e.g. by calling an external tool like optipng or jpegtran. It may return
+// the content unchanged if the image can't be optimized.
+type ImageOptimizer func(content []byte) ([]byte, error)
+
+// RegisterImageOptimizers registers the ImageOptimizerRule optimizing the collected
+// PNG images with the png optimizer and JPEG images with the jpeg one. Nil optimizers
+// are skipped. Register the rule itself to limit it with a pattern or a priority.
+func (s *Storage) RegisterImageOptimizers(png, jpeg ImageOptimizer) {
+	s.RegisterRule(ImageOptimizerRule(png, jpeg))
+}
+
+// ImageOptimizerRule returns the rule optimizing the PNG images with the png optimizer
+// and JPEG images with the jpeg one. Nil optimizers are skipped. Optimized content is kept
+// only if it's smaller, the storage file is rehashed and renamed then like with
+// the PostProcessTemplate. CSS files are post-processed after the other ones,
+// so the references to the images get the final names.
+func ImageOptimizerRule(png, jpeg ImageOptimizer) PostProcessRule {
+	optimizers := make(map[string]ImageOptimizer)
+	if png != nil {
+		optimizers[".png"] = png
+	}
+	if jpeg != nil {
+		optimizers[".jpg"] = jpeg
+		optimizers[".jpeg"] = jpeg
+	}
+
+	return func(storage *Storage, file *StaticFile) error {
+		optimizer, ok := optimizers[strings.ToLower(storage.fileExt(file.RelPath))]
+		if !ok || file.Path == "" {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(file.StoragePath)
+		if err != nil {
+			return err
+		}
+
+		optimized, err := optimizer(content)
+		if err != nil {
+			return err
+		}
+
+		if len(optimized) >= len(content) {
+			return nil
+		}
+		return rewriteStorageFile(storage, file, optimized)
+	}
+}
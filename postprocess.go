@@ -1,9 +1,13 @@
 package staticfiles
 
 import (
+	"crypto/md5"
+	"fmt"
 	"io/ioutil"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -14,6 +18,23 @@ var (
 		regexp.MustCompile(`@import\s*['"](?P<url>.*?)['"]`),
 		regexp.MustCompile(`sourceMappingURL=(?P<url>[-\\.\w]+)`),
 	}
+	importRegex         = regexp.MustCompile(`@import\s*(?:url\()?\s*['"]?(?P<url>[^'"\)\s;]+)`)
+	templateVarPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?:/\*)?\{\{\s*(?P<name>\w+)\s*\}\}(?:\*/)?`),
+		regexp.MustCompile(`\$\{(?P<name>\w+)\}`),
+	}
+	// referencePatterns find the references checked with the Storage.FailOnBrokenReferences
+	// by the lowercased file extensions
+	referencePatterns = map[string][]*regexp.Regexp{
+		".css": urlPatterns,
+		".js": {
+			regexp.MustCompile(`(?:\bfrom|\bimport)\s*\(?\s*['"](?P<url>\.{1,2}/[^'"]+)['"]`),
+			regexp.MustCompile(`sourceMappingURL=(?P<url>[-\\.\w]+)`),
+		},
+		".html": {
+			regexp.MustCompile(`\b(?:src|href)\s*=\s*['"](?P<url>[^'"]*)['"]`),
+		},
+	}
 )
 
 // PostProcessCSS fixes files references in CSS files to point
@@ -22,18 +43,24 @@ var (
 // 		@import "path/file.ext"
 // 		url("path/file.ext")
 // 		sourceMappingURL=file.ext.map
+//
+// References to the files missing in the Storage.FilesMap are passed
+// to the Storage.URLRewriteFallback if it's set. References to the collected
+// files are recorded for the Storage.Referrers.
 func PostProcessCSS(storage *Storage, file *StaticFile) error {
 	if filepath.Ext(file.Path) != ".css" {
 		return nil
 	}
 
-	buf, err := ioutil.ReadFile(file.Path)
+	buf, err := storage.readSource(file.Path)
 	if err != nil {
 		return err
 	}
 
 	content := string(buf)
 	changed := false
+	storageDir := filepath.Dir(file.StoragePath)
+	var references []string
 
 	for _, regex := range urlPatterns {
 		content = regex.ReplaceAllStringFunc(content, func(s string) string {
@@ -46,25 +73,337 @@ func PostProcessCSS(storage *Storage, file *StaticFile) error {
 
 			urlFileName := filepath.Base(url)
 			urlFilePath := filepath.ToSlash(filepath.Join(filepath.Dir(file.Path), url))
+			found := false
 
 			for _, file := range storage.FilesMap {
 				if file.Path == urlFilePath {
+					found = true
+					references = append(references, file.RelPath)
+					if storage.ContentAddressed {
+						// Files are moved to the other directories,
+						// so the whole url is replaced
+						relURL, err := filepath.Rel(storageDir, file.StoragePath)
+						if err != nil {
+							break
+						}
+						s = strings.Replace(s, url, filepath.ToSlash(relURL), 1)
+						changed = true
+						break
+					}
+
 					hashedName := filepath.Base(file.StoragePath)
+					if file.Hash != "" {
+						hashedName += "?v=" + file.Hash
+					}
 					s = strings.Replace(s, urlFileName, hashedName, 1)
 					changed = true
 					break
 				}
 			}
 
+			if !found && url != "" && storage.URLRewriteFallback != nil {
+				if rewritten, ok := storage.URLRewriteFallback(url); ok {
+					s = strings.Replace(s, url, rewritten, 1)
+					changed = true
+				}
+			}
+
 			return s
 		})
 	}
 
+	storage.setReferences(file.RelPath, references)
+
+	// The rewritten references contain the hashes of the referenced files
+	if changed && storage.rehashesCSS() {
+		return rewriteStorageFile(storage, file, []byte(content))
+	}
+
 	if changed {
-		err = ioutil.WriteFile(file.StoragePath, []byte(content), 0)
+		err = storage.writeStorageFile(file.StoragePath, []byte(content))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PostProcessTemplate substitutes Storage.TemplateVars into CSS and JS files
+// in the following forms:
+//
+// 		${VAR}
+// 		{{VAR}}
+// 		/*{{VAR}}*/
+//
+// Unknown variables are left untouched. The rule works on the already
+// post-processed storage file, so it must be registered after PostProcessCSS.
+// When the content changes the file hash is recomputed and the storage file
+// is renamed accordingly, unless the file is pinned. In the Storage.QueryStringMode
+// the file is updated in place and its query string hash is recomputed.
+// The rule isn't registered by default.
+func PostProcessTemplate(storage *Storage, file *StaticFile) error {
+	ext := filepath.Ext(file.Path)
+	if (ext != ".css" && ext != ".js") || len(storage.TemplateVars) == 0 {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(file.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	content := string(buf)
+	changed := false
+
+	for _, regex := range templateVarPatterns {
+		content = regex.ReplaceAllStringFunc(content, func(s string) string {
+			name := findSubmatchGroup(regex, s, "name")
+			if value, ok := storage.TemplateVars[name]; ok {
+				changed = true
+				return value
+			}
+			return s
+		})
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return rewriteStorageFile(storage, file, []byte(content))
+}
+
+// rehashesCSS reports whether PostProcessCSS names the rewritten CSS files by their
+// rewritten content. It's the case with the Storage.HashDependencies and in the
+// Storage.ContentAddressed mode, where the files with the same source in the different
+// directories would share the storage file otherwise, while their references differ.
+// The files are post-processed serially with the imported CSS files first then.
+func (s *Storage) rehashesCSS() bool {
+	return (s.HashDependencies || s.ContentAddressed) && s.versionSegment() == ""
+}
+
+// rewriteStorageFile replaces the content of the storage file with the Storage.OutputBackend,
+// recomputes its hash and renames the storage file accordingly, unless the file is pinned.
+// The previous storage file is removed unless it's used by the other file, e.g. the one
+// with the same content in the Storage.ContentAddressed mode. In the Storage.QueryStringMode
+// the file is updated in place and its query string hash is recomputed.
+func rewriteStorageFile(storage *Storage, file *StaticFile, content []byte) error {
+	sum := md5.Sum(content)
+	if file.Pinned || file.Hash != "" {
+		err := storage.writeStorageFile(file.StoragePath, content)
+		if err == nil && file.Hash != "" {
+			storage.filesLock.Lock()
+			file.Hash = storage.formatHash(sum[:])
+			storage.filesLock.Unlock()
+		}
+		return err
+	}
+
+	storagePath := filepath.ToSlash(filepath.Join(filepath.Dir(file.StoragePath), storage.storageName(file.Path, sum[:])))
+	err := storage.writeStorageFile(storagePath, content)
+	if err != nil {
+		return err
+	}
+
+	prevStoragePath := file.StoragePath
+
+	storage.filesLock.Lock()
+	file.StoragePath = storagePath
+	file.StorageRelPath = strings.TrimPrefix(storagePath, storage.OutputDir)
+	storage.resetIndexes()
+	storage.filesLock.Unlock()
+
+	if storagePath != prevStoragePath && !storage.storagePathUsed(prevStoragePath) {
+		return storage.outputBackend().Delete(prevStoragePath)
+	}
+	return nil
+}
+
+// storagePathUsed reports whether any file of the Storage.FilesMap is stored with the path.
+func (s *Storage) storagePathUsed(storagePath string) bool {
+	for _, sf := range s.FilesMap {
+		if sf.StoragePath == storagePath {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportCycleError is returned when CSS files import each other in a loop while
+// they must be post-processed after the imported ones, see Storage.rehashesCSS.
+type ImportCycleError struct {
+	Cycle []string // relative paths of the files forming the cycle, the first one is repeated at the end
+}
+
+func (e *ImportCycleError) Error() string {
+	return fmt.Sprintf("circular CSS @import: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// cssImports returns the collected files imported by the CSS file with @import rule.
+func cssImports(storage *Storage, file *StaticFile) ([]*StaticFile, error) {
+	buf, err := storage.readSource(file.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var imports []*StaticFile
+	for _, match := range importRegex.FindAllStringSubmatch(string(buf), -1) {
+		url := match[1]
+		if ignoreRegex.MatchString(url) {
+			continue
+		}
+
+		urlFilePath := filepath.ToSlash(filepath.Join(filepath.Dir(file.Path), url))
+		for _, sf := range storage.FilesMap {
+			if sf.Path == urlFilePath {
+				imports = append(imports, sf)
+				break
+			}
+		}
+	}
+
+	return imports, nil
+}
+
+// orderByImports returns the files sorted by their relative paths and then reordered
+// so the CSS files follow the CSS files they import, e.g. to rewrite the references with
+// the final names of the imported files. ImportCycleError is returned if any of the files
+// imports itself directly or through the other files, since no such order exists then.
+func orderByImports(storage *Storage, files []*StaticFile) ([]*StaticFile, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	sorted := make([]*StaticFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].RelPath < sorted[j].RelPath
+	})
+
+	state := make(map[*StaticFile]int, len(files))
+	for _, sf := range files {
+		state[sf] = unvisited
+	}
+
+	ordered := make([]*StaticFile, 0, len(files))
+	var stack []*StaticFile
+	var visit func(sf *StaticFile) error
+
+	visit = func(sf *StaticFile) error {
+		state[sf] = visiting
+		stack = append(stack, sf)
+
+		if sf.Path != "" && filepath.Ext(sf.Path) == ".css" {
+			imports, err := cssImports(storage, sf)
+			if err != nil {
+				return err
+			}
+
+			for _, imp := range imports {
+				// Files which aren't post-processed are skipped
+				impState, ok := state[imp]
+				if !ok {
+					continue
+				}
+
+				switch impState {
+				case visiting:
+					var cycle []string
+					for i := len(stack) - 1; i >= 0; i-- {
+						if stack[i] == imp {
+							for _, f := range stack[i:] {
+								cycle = append(cycle, f.RelPath)
+							}
+							break
+						}
+					}
+					return &ImportCycleError{Cycle: append(cycle, imp.RelPath)}
+				case unvisited:
+					if err = visit(imp); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[sf] = visited
+		ordered = append(ordered, sf)
+		return nil
+	}
+
+	for _, sf := range sorted {
+		if state[sf] == unvisited {
+			if err := visit(sf); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ordered, nil
+}
+
+// BrokenReferenceError is returned with the Storage.FailOnBrokenReferences
+// when the post-processed file references the file missing in the storage.
+type BrokenReferenceError struct {
+	RelPath string // original relative path of the referencing file
+	URL     string // reference as it's written in the storage file
+}
+
+func (e *BrokenReferenceError) Error() string {
+	return fmt.Sprintf("broken reference '%s' in '%s'", e.URL, e.RelPath)
+}
+
+// checkReferences scans the post-processed storage files of the CSS, JS and HTML files
+// for the relative references and returns BrokenReferenceError for the first reference
+// resolved neither to the storage file nor to the original relative path of the collected file.
+// Absolute paths, urls with schemes and fragment-only references are skipped.
+func checkReferences(storage *Storage, files []*StaticFile) error {
+	storagePaths := storage.storagePaths()
+
+	sorted := make([]*StaticFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].RelPath < sorted[j].RelPath
+	})
+
+	for _, sf := range sorted {
+		patterns := referencePatterns[strings.ToLower(filepath.Ext(sf.RelPath))]
+		if sf.Path == "" || len(patterns) == 0 {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(sf.StoragePath)
 		if err != nil {
 			return err
 		}
+
+		for _, regex := range patterns {
+			for _, match := range regex.FindAllStringSubmatch(string(buf), -1) {
+				url := strings.TrimSpace(match[1])
+				if url == "" || ignoreRegex.MatchString(url) || strings.HasPrefix(url, "/") ||
+					strings.HasPrefix(url, "#") || strings.HasPrefix(url, "?") {
+					continue
+				}
+
+				urlPath := url
+				if i := strings.IndexAny(urlPath, "?#"); i != -1 {
+					urlPath = urlPath[:i]
+				}
+
+				if storagePaths[path.Join(path.Dir(sf.StorageRelPath), urlPath)] {
+					continue
+				}
+				if _, ok := storage.FilesMap[path.Join(path.Dir(sf.RelPath), urlPath)]; ok {
+					continue
+				}
+
+				return &BrokenReferenceError{RelPath: sf.RelPath, URL: url}
+			}
+		}
 	}
 
 	return nil
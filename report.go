@@ -0,0 +1,101 @@
+package staticfiles
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// WriteReport writes a human-readable table of the Storage.FilesMap files to w
+// sorted by the original relative paths. Each row contains the original and
+// the storage relative paths and the storage file size in bytes, or "-" if
+// the file can't be read. With the Storage.ReportSRI the subresource integrity
+// hash of the storage file is added as well.
+func (s *Storage) WriteReport(w io.Writer) error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	relPaths := make([]string, 0, len(s.FilesMap))
+	for relPath := range s.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	header := "ORIGINAL\tSTORAGE\tSIZE"
+	if s.ReportSRI {
+		header += "\tSRI"
+	}
+	fmt.Fprintln(tw, header)
+
+	for _, relPath := range relPaths {
+		sf := s.FilesMap[relPath]
+		storagePath := filepath.Join(s.OutputDir, sf.StorageRelPath)
+
+		size := "-"
+		if stat, err := os.Stat(storagePath); err == nil {
+			size = strconv.FormatInt(stat.Size(), 10)
+		}
+
+		row := relPath + "\t" + sf.resolvedPath() + "\t" + size
+		if s.ReportSRI {
+			integrity, err := fileIntegrity(storagePath)
+			if err != nil {
+				integrity = "-"
+			}
+			row += "\t" + integrity
+		}
+		fmt.Fprintln(tw, row)
+	}
+
+	return tw.Flush()
+}
+
+// fileIntegrity returns the subresource integrity hash of the file content.
+func fileIntegrity(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha512.Sum384(content)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// CSPHash returns the Content-Security-Policy source hash of the file with the original
+// relative path, e.g. "sha256-<base64>" to allow the file inlined into the page with
+// the "script-src" or "style-src" directive. The storage file is hashed, or the input
+// one when the storage is disabled. An empty string is returned if the file is unknown
+// or can't be read.
+func (s *Storage) CSPHash(relPath string) string {
+	name := relPath
+	if s.Enabled {
+		sf, ok := s.findFile(relPath)
+		if !ok {
+			return ""
+		}
+		name = sf.StorageRelPath
+	}
+
+	f, err := s.openFile(path.Clean("/" + name))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return ""
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
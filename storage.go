@@ -10,45 +10,412 @@
 package staticfiles
 
 import (
+	"bytes"
 	"crypto/md5"
+	"encoding/base32"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-const hashLength int = 12
+// Lengths of the hash sums in the storage file names. Shorter encodings
+// keep at least the same number of bits as the hex one.
+const (
+	hashLength       int = 12
+	base32HashLength int = 10
+	base62HashLength int = 9
+)
+
+// HashEncoding defines how the hash sums in the storage file names are encoded.
+// All encodings are filesystem- and URL-safe.
+type HashEncoding int
+
+const (
+	Hex    HashEncoding = iota // lowercase hex digits (default)
+	Base32                     // lowercase RFC 4648 base32 alphabet without padding
+	Base62                     // digits and both case letters, so it isn't safe for case-insensitive filesystems
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrCopySizeMismatch is returned when the number of bytes written
+// to the storage file differs from the original file size.
+var ErrCopySizeMismatch = errors.New("copied file size mismatch")
+
+// ErrOutputNotWritable is returned by Storage.CollectStatic when the Storage.OutputDir
+// can't be written, e.g. because of the permissions or a read-only filesystem.
+var ErrOutputNotWritable = errors.New("output directory is not writable")
+
+// ErrOutsideInputDirs is returned by Storage.CollectFiles for the files
+// located outside of the input directories.
+var ErrOutsideInputDirs = errors.New("file is outside of the input directories")
+
+// ErrOutsideOutputDir is returned when the storage file to remove is located
+// outside of the Storage.OutputDir, e.g. the manifest entry contains ".."
+// or the path goes through a symlink pointing elsewhere.
+var ErrOutsideOutputDir = errors.New("file is outside of the output directory")
+
+// ErrIntegrityMismatch is returned by Storage.Open when the Storage.VerifyOnOpen
+// is enabled and the storage file content doesn't match its recorded hash sum.
+var ErrIntegrityMismatch = errors.New("storage file integrity mismatch")
+
+// ErrInvalidVersion is returned by the collection when the Storage.VersionFunc
+// returns an empty version or the one pointing outside of the Storage.OutputDir.
+var ErrInvalidVersion = errors.New("invalid version")
+
+// ErrAssetNotFound is returned by Storage.ResolveE for the paths
+// missing in the Storage.FilesMap.
+var ErrAssetNotFound = errors.New("asset not found")
+
+// IgnoreFilename is the name of the file in the root of the input directory
+// listing glob-style patterns of the files and directories to skip while collecting
+// from that directory, one per line. Patterns without a slash match the names at any depth
+// and patterns ending with a slash match directories only, like in .gitignore.
+const IgnoreFilename string = ".staticfilesignore"
+
+// DefaultIgnorePatterns lists glob-style patterns of the hidden and
+// editor temporary files skipped when Storage.IgnoreHidden is enabled.
+// Patterns are matched against each element of the relative file path.
+var DefaultIgnorePatterns = []string{
+	".*",
+	"*~",
+	"*.swp",
+	"*.swo",
+	"Thumbs.db",
+	"desktop.ini",
+}
+
+// MissingPolicy defines how Storage.Resolve behaves when the path
+// is not found in the Storage.FilesMap.
+type MissingPolicy int
+
+const (
+	ReturnEmpty    MissingPolicy = iota // return an empty string (default)
+	ReturnOriginal                      // return the path passed to Resolve unchanged
+	Panic                               // panic with a message containing the path
+)
+
+// VersionMismatchPolicy defines how Storage.LoadManifest and Storage.ReadManifest
+// behave when the manifest version differs from the ManifestVersion.
+type VersionMismatchPolicy int
+
+const (
+	VersionMismatchError   VersionMismatchPolicy = iota // return ErrManifestVersionMismatch (default)
+	VersionMismatchRebuild                              // ignore the manifest, so the next CollectStatic regenerates it
+)
+
+// DefaultCompoundExtensions lists multi-part extensions kept whole
+// after the hash sum in the storage file names.
+var DefaultCompoundExtensions = []string{".tar.gz", ".tar.bz2", ".tar.xz"}
+
+// ImageVariantExtensions lists the extensions of the image variants
+// served by the Storage.ImageVariants in the order of preference.
+var ImageVariantExtensions = []string{".avif", ".webp"}
+
+// LatestDir is the directory in the Storage.OutputDir the latest copies
+// of the files are written to with the Storage.EmitLatestAlias.
+const LatestDir string = "latest"
+
+// DefaultCacheControl is the Cache-Control header value set by the Storage.Handler
+// for the storage files without a cache policy.
+const DefaultCacheControl string = "public, max-age=31536000, immutable"
+
+// RevalidateCacheControl is the Cache-Control header value set by the Storage.Handler
+// instead of the DefaultCacheControl for the storage files whose URLs don't change
+// along with their content, e.g. the pinned ones or the files of the Storage.QueryStringMode
+// requested without the matching "?v=<hash>" query string, so the clients revalidate them.
+const RevalidateCacheControl string = "no-cache"
 
 type StaticFile struct {
-	Path           string // Original file path
-	RelPath        string // Original file path relative to the one of the Storage.inputDirs
-	StoragePath    string // Storage file path
-	StorageRelPath string // Storage file path relative to the Storage.OutputDir
+	Path           string    // Original file path
+	RelPath        string    // Original file path relative to the one of the Storage.inputDirs
+	StoragePath    string    // Storage file path
+	StorageRelPath string    // Storage file path relative to the Storage.OutputDir
+	CacheControl   string    // Cache-Control header value overriding the DefaultCacheControl
+	Pinned         bool      // Storage file name is fixed with Storage.Pin and doesn't depend on the content
+	Hash           string    // Content hash sum appended as a query string in the Storage.QueryStringMode
+	ContentHash    string    // Hex-encoded MD5 sum of the collected file content recorded with the Storage.RecordContentHash
+	ContentType    string    // MIME type recorded with the Storage.RecordContentType
+	Digest         string    // Storage file content hash sum recorded with the Storage.VerifyOnOpen
+	ModTime        time.Time // Original file modification time recorded with the Storage.RecordModTime
+	// Storage file size and the sizes of its compressed copies by the content encoding,
+	// e.g. "gzip", recorded when the compression is enabled
+	Size            int64
+	CompressedSizes map[string]int64
+	LatestRelPath   string // path of the copy written with the Storage.EmitLatestAlias relative to the Storage.OutputDir
+}
+
+// resolvedPath returns the storage relative file path with
+// the cache-busting query string if the file has one.
+func (sf *StaticFile) resolvedPath() string {
+	if sf.Hash != "" {
+		return sf.StorageRelPath + "?v=" + sf.Hash
+	}
+	return sf.StorageRelPath
+}
+
+type cachePolicy struct {
+	pattern string
+	value   string
 }
 
 // PostProcessRule describes the type of a post-process rule functions.
+// It implements Processor with no-op Setup and Teardown.
 type PostProcessRule func(*Storage, *StaticFile) error
 
+func (r PostProcessRule) Setup(*Storage) error {
+	return nil
+}
+
+func (r PostProcessRule) Process(storage *Storage, file *StaticFile) error {
+	return r(storage, file)
+}
+
+func (r PostProcessRule) Teardown() error {
+	return nil
+}
+
+// GlobalRule describes the type of a post-process rule functions
+// applied once to all files rather than to each file.
+type GlobalRule func(*Storage) error
+
+// Processor is a post-processor with a lifecycle. Setup is called once
+// before the files are processed, Process is called for every file and
+// Teardown is called once after processing, even if it has failed.
+type Processor interface {
+	Setup(*Storage) error
+	Process(*Storage, *StaticFile) error
+	Teardown() error
+}
+
+type postProcessRule struct {
+	processor  Processor
+	textOnly   bool   // skip binary files
+	concurrent bool   // safe to run in parallel with the other concurrent rules
+	pattern    string // glob-style pattern of the relative paths of the files to process
+	priority   int    // rules with the lower priority are applied first
+}
+
+// Transform returns the transformed content of the file, see Storage.AddTransform.
+type Transform func(content []byte) ([]byte, error)
+
+type transform struct {
+	ext       string // lowercased file extension
+	transform Transform
+}
+
 type Storage struct {
 	OutputDir        string
 	outputDirFS      http.FileSystem
 	FilesMap         map[string]*StaticFile
-	postProcessRules []PostProcessRule
+	postProcessRules []postProcessRule
+	transforms       []transform
+	transformDir     string // temporary directory of the transformed files during the collection
 	inputDirs        []string
+	inputPrefixes    map[string]string // input directories mapped to the relative path prefixes, see AddInputDirAs
 	OutputDirList    bool
 	Enabled          bool
 	Verbose          bool // toggles verbose output to the standard logger
 	ignorePatterns   []string
+	MissingPolicy    MissingPolicy        // Resolve behaviour for unknown paths
+	OnMissing        func(relPath string) // optional callback called by Resolve for unknown paths
+	TemplateVars     map[string]string    // variables substituted by the PostProcessTemplate rule
+	cachePolicies    []cachePolicy
+	CaseInsensitive  bool              // match paths regardless of case in Resolve
+	caseIndex        map[string]string // lowercased Storage.FilesMap keys, built on demand
+	outputMirrors    []string
+	rewriteRegex     *regexp.Regexp         // matches Storage.FilesMap keys, built on demand
+	storageIndex     map[string]*StaticFile // Storage.FilesMap values by the storage relative paths, built on demand
+	IgnoreHidden     bool                   // skip files matching the DefaultIgnorePatterns
+	pins             map[string]string
+	aliases          map[string]string // logical names mapped to the original relative paths, see Alias
+	CompressManifest bool              // save the manifest gzipped as ManifestGzipFilename
+	// ManifestPathPrefix is prepended to the storage relative file paths saved
+	// in the manifest, e.g. "static/". It's stripped when the manifest is loaded.
+	ManifestPathPrefix string
+	// ManifestIndent, if set, e.g. to two spaces, makes the saved manifest indented
+	// with it one key per line ending with a newline, so the manifest committed to
+	// the version control gets readable diffs. Keys are always sorted.
+	ManifestIndent string
+	// QueryStringMode keeps the original file names in the storage and appends
+	// the content hash as a "?v=<hash>" query string to the resolved paths instead.
+	// The Storage.Handler lets the clients cache only the URLs with the current hash forever.
+	QueryStringMode bool
+	// Gzip enables writing gzip-compressed copies of the storage files
+	// except the ones with the IncompressibleExtensions.
+	Gzip bool
+	// Brotli enables writing brotli-compressed copies of the same storage files
+	// with the encoder, see Encoder.
+	Brotli                   Encoder
+	IncompressibleExtensions []string // overrides the DefaultIncompressibleExtensions when not nil
+	CompressibleExtensions   []string // compress only the files with these extensions when not nil
+	CompoundExtensions       []string // overrides the DefaultCompoundExtensions when not nil
+	ignoreDirs               []string // directories skipped while collecting
+	IndexFile                string   // file served on the directory request if present, e.g. "index.html"
+	// NoHashExtensions lists extensions of the files stored with their original names
+	// like the pinned ones, e.g. ".map" or ".wasm" files loaded by the fixed names.
+	NoHashExtensions []string
+	// ContentAddressed stores files as "<hash>.<ext>" right in the Storage.OutputDir
+	// regardless of their original names and directories. The CSS files with the rewritten
+	// references are named by their post-processed content, see PostProcessCSS.
+	ContentAddressed bool
+	ManifestChecksum bool // write the ManifestChecksumFilename and require it in LoadManifest
+	// VersionSegment places all files under the "Storage.OutputDir/<segment>/" directory,
+	// e.g. "v/1234", keeping the original file names instead of hashing each file.
+	VersionSegment string
+	// VersionFunc derives the version directory placed under the VersionSegment,
+	// e.g. "v/<commit>", from the git commit or the environment variable. It's called
+	// once by each collection. The segment is kept as is when the VersionFunc is nil.
+	VersionFunc func() (string, error)
+	version     string // version returned by the VersionFunc for the last collection
+	// Workers is the number of goroutines post-processing files.
+	// Files are processed serially when it's less than two.
+	Workers     int
+	globalRules []GlobalRule
+	MaxFileSize int64 // files larger than this size in bytes are not collected, no limit if zero
+	// OnVersionMismatch is applied when the manifest is loaded explicitly.
+	// NewStorage always returns ErrManifestVersionMismatch.
+	OnVersionMismatch VersionMismatchPolicy
+	HashEncoding      HashEncoding // encoding of the hash sums in the storage file names
+	// HashLength is the number of the hash sum characters in the storage file names,
+	// the default one of the Storage.HashEncoding is used if zero. The hash sums of
+	// the colliding files are extended while collecting, see Storage.hashAndCopy.
+	HashLength int
+	// URLRewriteFallback is called by PostProcessCSS with the references missing
+	// in the Storage.FilesMap. The reference is replaced with the returned value
+	// if the second returned value is true and is left unchanged otherwise.
+	URLRewriteFallback func(rawURL string) (string, bool)
+	// RecordContentType detects the MIME type of each collected file by its extension
+	// or content and stores it in the manifest. See Storage.ContentType.
+	RecordContentType bool
+	pendingFiles      []*StaticFile // files added with AddProcessedFile during the current pass
+	pendingLock       sync.Mutex
+	// VerifyOnOpen makes Open check the content of the storage files against
+	// their hash sums and return ErrIntegrityMismatch if they differ. The hash sums
+	// of the storage files content are recorded in the manifest when the files are
+	// collected with the option enabled, files without them aren't checked.
+	// Verified files aren't read again until their size or modification time changes.
+	VerifyOnOpen bool
+	ReportSRI    bool           // add the subresource integrity hashes to the WriteReport table
+	closers      []func() error // called by Close in the reverse order, e.g. to stop the watchers
+	closeLock    sync.Mutex
+	closed       bool
+	// RecordModTime stores the original files modification times in the manifest.
+	// Files opened with Open report them, so the Handler sets the Last-Modified
+	// header and answers the conditional requests by them.
+	RecordModTime  bool
+	references     map[string][]string // relative paths of the referencing files mapped to the referenced ones
+	referencesLock sync.Mutex
+	// CleanURLs serves the storage files by the original relative paths, e.g. "css/style.css",
+	// while the files are still hashed on disk. Open maps the paths to the storage files
+	// and Resolve returns the original paths of the known files. The Handler doesn't set
+	// the Cache-Control header for such URLs, since their content changes between builds.
+	CleanURLs bool
+	// PreserveEmptyDirs recreates the empty input directories in the Storage.OutputDir.
+	// Ignored and hidden directories are skipped. The Storage.OutputBackend must be
+	// the DirBackend, UnsupportedOptionError is returned otherwise.
+	PreserveEmptyDirs bool
+	OutputBackend     OutputBackend // writes the copied files and the manifest, the FileBackend if nil
+	// RemoveStale makes CollectStatic remove the storage files of the previous manifest
+	// replaced by the new ones, e.g. the files with the outdated hash sums, from
+	// the Storage.OutputDir. Files outside of it are never removed, ErrOutsideOutputDir
+	// is returned instead.
+	RemoveStale bool
+	// ImageVariants makes the Handler serve the ImageVariantExtensions variants of the images,
+	// e.g. "img/photo.webp" for "img/photo.png", to the clients accepting them.
+	// The variants are the collected files with the same path and the other extension.
+	ImageVariants bool
+	// OpenFallbackToSource makes Open serve the original file of the known storage file
+	// missing in the Storage.OutputDir, e.g. after a partial deploy, logging a warning.
+	// The original files aren't post-processed, so the references in them aren't resolved.
+	OpenFallbackToSource bool
+	// MaxDepth limits the depth of the input directories walked while collecting,
+	// e.g. the files in "css/" have depth 1. MaxDepthError is returned when
+	// the limit is exceeded. Zero means unlimited.
+	MaxDepth int
+	// HashDependencies makes the storage names of the CSS files depend on the files
+	// they reference, so a changed image invalidates the CSS files pointing to it even if
+	// their source is untouched. PostProcessCSS rehashes the files by their rewritten
+	// content then, so the files are post-processed serially with the imported CSS files
+	// first and ImportCycleError is returned for the circular imports. It has no effect
+	// with the Storage.VersionSegment.
+	HashDependencies bool
+	// WriteChangeLog makes CollectStatic write the ChangeLogFilename listing the files
+	// added, changed and removed comparing to the manifest loaded before the collection,
+	// e.g. to purge the CDN caches.
+	WriteChangeLog bool
+	// OnFileCollected, if not nil, is called with each file copied to the storage or
+	// found there already while collecting, before the post-processing, e.g. to upload it.
+	// The collection is aborted if it returns an error. The collected files are added to
+	// the Storage.FilesMap once they are all copied, so Resolve returns the previous paths here.
+	OnFileCollected func(sf *StaticFile) error
+	// TempDir is the directory the storage files are staged in before they are renamed
+	// to their storage paths. It must be on the same device as the Storage.OutputDir,
+	// since the renames across devices fail. Files are staged in the directories of their
+	// storage paths if it's empty, which keeps the renames atomic. With the backends other
+	// than FileBackend the files aren't renamed and are staged in the system temporary
+	// directory by default. The transformed files of AddTransform are written there too,
+	// or to the system temporary directory.
+	TempDir string
+	// UseHardLinks makes the collection hard link the storage files to the source ones
+	// instead of copying them when they are on the same file system. The files are copied
+	// otherwise. Rules rewriting the storage files in place must remove them first,
+	// so the source files aren't changed along.
+	UseHardLinks bool
+	// noProcessPatterns are the patterns of the relative paths of the files
+	// excluded from the post-processing, see AddNoProcessPattern.
+	noProcessPatterns []string
+	// EmitLatestAlias makes the collection write the copies of the storage files
+	// to the "LatestDir/<relPath>" paths replaced by each build, e.g. to serve
+	// the stable URLs along with the immutable hashed ones. The copies are recorded
+	// in the manifest and don't get the DefaultCacheControl from the Handler.
+	EmitLatestAlias bool
+	// FailOnBrokenReferences makes the collection return BrokenReferenceError
+	// when the post-processed CSS, JS or HTML file contains the relative reference
+	// to the file missing in the storage, e.g. because of a typo in the file name.
+	FailOnBrokenReferences bool
+	// StaticURL is the base URL the Storage.OutputDir is served under,
+	// e.g. "/static/" or the CDN URL, used by the URLForStorageRelPath and PreloadLinks.
+	StaticURL string
+	// RecordContentHash stores the hash sums of the collected files content in the manifest
+	// separately from the storage file names. See Storage.Hash.
+	RecordContentHash bool
+	// filesLock guards the Storage.FilesMap and its files, so Resolve, Open,
+	// the handlers and the methods reading the whole map, e.g. Stats or WriteManifest,
+	// are safe for use concurrently with the collection and the manifest reloading.
+	// The collection builds the new map without the lock and swaps it in, then holds
+	// the lock for writing only while updating the files, so the rules and callbacks
+	// may call these methods as well.
+	filesLock sync.RWMutex
+	buildLock sync.Mutex // serializes the collections and the manifest reloads replacing the Storage.FilesMap
+	indexLock sync.Mutex // guards the lookup structures built on demand
+	// storage files checked by the Storage.VerifyOnOpen by their relative paths, guarded by the indexLock
+	verified map[string]verifiedFile
+
+	collectOnce sync.Once
+	collectErr  error // error returned by the last collection run with the CollectOnce or ForceCollect
+	collectLock sync.Mutex
 }
 
 // NewStorage returns new Storage initialized with the root directory and
 // registered rule to post-process CSS files.
 func NewStorage(outputDir string) (*Storage, error) {
 	outputDir = filepath.ToSlash(filepath.Clean(outputDir)) + "/"
-	filesMap, err := loadManifest(outputDir)
+	filesMap, err := loadManifest(outputDir, false)
 	if (err != nil) && !os.IsNotExist(err) {
 		return nil, err
 	}
@@ -60,7 +427,7 @@ func NewStorage(outputDir string) (*Storage, error) {
 		OutputDirList: true,
 		Enabled:       true,
 	}
-	s.RegisterRule(PostProcessCSS)
+	s.RegisterConcurrentRule(PostProcessCSS)
 
 	return s, nil
 }
@@ -69,201 +436,2618 @@ func (s *Storage) AddInputDir(path string) {
 	s.inputDirs = append(s.inputDirs, filepath.ToSlash(filepath.Clean(path))+"/")
 }
 
+// AddInputDirAs adds the input directory whose files are placed under
+// the prefix subdirectory of the Storage.OutputDir, so the files with the same
+// relative paths in different input directories don't collide. The prefix
+// is prepended to the relative paths used as the manifest keys as well.
+func (s *Storage) AddInputDirAs(path, prefix string) {
+	dir := filepath.ToSlash(filepath.Clean(path)) + "/"
+	s.inputDirs = append(s.inputDirs, dir)
+
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	if prefix == "" {
+		return
+	}
+
+	if s.inputPrefixes == nil {
+		s.inputPrefixes = make(map[string]string)
+	}
+	s.inputPrefixes[dir] = prefix + "/"
+}
+
+// inputRelPath returns the file path relative to the input directory dir
+// for the relative path with the directory prefix. It returns false
+// if the relative path is located outside the prefix.
+func (s *Storage) inputRelPath(dir, relPath string) (string, bool) {
+	prefix := s.inputPrefixes[dir]
+	if !strings.HasPrefix(relPath, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(relPath, prefix), true
+}
+
+// AddOutputMirror adds the directory to replicate the Storage.OutputDir to.
+// Mirrors receive the same post-processed files and manifest once collecting
+// is finished, so the files are hashed and processed only once.
+func (s *Storage) AddOutputMirror(dir string) {
+	s.outputMirrors = append(s.outputMirrors, filepath.ToSlash(filepath.Clean(dir))+"/")
+}
+
 func (s *Storage) AddIgnorePattern(pattern string) {
 	s.ignorePatterns = append(s.ignorePatterns, pattern)
 }
 
-func (s *Storage) RegisterRule(rule PostProcessRule) {
-	s.postProcessRules = append(s.postProcessRules, rule)
+// AddNoProcessPattern excludes the files whose relative path matches the glob-style
+// pattern from the post-processing, so they are copied verbatim, e.g. a vendor bundle
+// with the literal url() strings. Patterns are matched like in RegisterRuleForPattern.
+func (s *Storage) AddNoProcessPattern(pattern string) {
+	s.noProcessPatterns = append(s.noProcessPatterns, pattern)
 }
 
-func (s *Storage) hashFilename(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
+// isNoProcess reports whether the file is excluded from the post-processing.
+func (s *Storage) isNoProcess(relPath string) bool {
+	for _, pattern := range s.noProcessPatterns {
+		if matchPath(pattern, relPath) {
+			return true
+		}
 	}
-	defer f.Close()
+	return false
+}
 
-	hash := md5.New()
-	if _, err = io.Copy(hash, f); err != nil {
-		return "", err
+// SetCachePolicy sets the Cache-Control header value for the files
+// whose relative path matches glob-style pattern. Patterns are matched like
+// in RegisterRuleForPattern, e.g. "fonts/**/*.woff2", and path.ErrBadPattern
+// is returned for the malformed ones. The policy is stored in the manifest
+// and applied by the Storage.Handler. When several patterns match the file,
+// the first one set wins.
+func (s *Storage) SetCachePolicy(pattern, value string) error {
+	if !validPattern(pattern) {
+		return path.ErrBadPattern
 	}
 
-	ext := filepath.Ext(path)
-	prefix := strings.TrimSuffix(path, ext)
-	sum := hex.EncodeToString(hash.Sum(nil))[:hashLength]
-
-	return prefix + "." + sum + ext, nil
+	s.cachePolicies = append(s.cachePolicies, cachePolicy{pattern: pattern, value: value})
+	return nil
 }
 
-func (s *Storage) copyFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
+func (s *Storage) matchCachePolicy(relPath string) string {
+	for _, policy := range s.cachePolicies {
+		if matchPath(policy.pattern, relPath) {
+			return policy.value
+		}
 	}
-	defer in.Close()
+	return ""
+}
 
-	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+// Pin forces the storage file name of the file with the original relative path
+// to be fixedStorageName regardless of the file content hash. The file is placed
+// in the same directory it would be placed without pinning. The Storage.Handler
+// makes the clients revalidate such files, see RevalidateCacheControl.
+func (s *Storage) Pin(relPath, fixedStorageName string) {
+	if s.pins == nil {
+		s.pins = make(map[string]string)
 	}
-	defer out.Close()
+	s.pins[relPath] = fixedStorageName
+}
 
-	if _, err = io.Copy(out, in); err != nil {
-		return err
+// Alias assigns the logical name to the file with the original relative path,
+// so templates don't depend on the files layout, e.g. Resolve("main-css")
+// returns the storage path of "css/style.css" after Alias("main-css", "css/style.css").
+// Aliases take precedence over the original relative paths.
+func (s *Storage) Alias(name, relPath string) {
+	if s.aliases == nil {
+		s.aliases = make(map[string]string)
 	}
+	s.aliases[name] = relPath
+}
 
-	err = out.Sync()
-	return err
+// unalias returns the original relative path of the alias or the path itself.
+func (s *Storage) unalias(relPath string) string {
+	if target, ok := s.aliases[relPath]; ok {
+		return target
+	}
+	return relPath
 }
 
-func (s *Storage) collectFiles() error {
-	for _, dir := range s.inputDirs {
-		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+// pinnedName returns the fixed storage file name of the file with the original
+// relative path, if it's pinned with Pin or has one of the Storage.NoHashExtensions.
+func (s *Storage) pinnedName(relPath string) (string, bool) {
+	if name, ok := s.pins[relPath]; ok {
+		return name, true
+	}
 
-			if info.IsDir() {
-				return nil
-			}
+	ext := strings.ToLower(s.fileExt(relPath))
+	for _, e := range s.NoHashExtensions {
+		if strings.ToLower(e) == ext {
+			return path.Base(relPath), true
+		}
+	}
+	return "", false
+}
 
-			path = filepath.ToSlash(path)
-			relPath := strings.TrimPrefix(path, dir)
-			for _, pattern := range s.ignorePatterns {
-				if ok, err := filepath.Match(pattern, relPath); ok || err != nil {
-					return nil
-				}
-			}
+// AddIgnoreDir excludes the directory with all its content from collecting
+// regardless of the ignore patterns, e.g. the Storage.OutputDir of another storage.
+func (s *Storage) AddIgnoreDir(path string) {
+	s.ignoreDirs = append(s.ignoreDirs, filepath.Clean(path))
+}
 
-			hashedPath, err := s.hashFilename(path)
-			if err != nil {
-				return err
-			}
+// isIgnoredDir reports whether the directory is added with AddIgnoreDir.
+// Paths are compared in the absolute form.
+func (s *Storage) isIgnoredDir(path string) (bool, error) {
+	if len(s.ignoreDirs) == 0 {
+		return false, nil
+	}
 
-			storageDir := filepath.Join(s.OutputDir, filepath.Dir(relPath))
-			storagePath := filepath.ToSlash(filepath.Join(storageDir, filepath.Base(hashedPath)))
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
 
-			if _, err := os.Stat(storagePath); os.IsNotExist(err) {
-				err = os.MkdirAll(storageDir, 0755)
-				if err != nil {
-					return err
-				}
+	for _, dir := range s.ignoreDirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return false, err
+		}
 
-				if s.Verbose {
-					log.Printf("Copying '%s'", relPath)
-				}
+		if absDir == absPath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-				err = s.copyFile(path, storagePath)
-				if err != nil {
-					return err
+// isIgnored reports whether the file matches any of the ignore patterns.
+func (s *Storage) isIgnored(relPath string) bool {
+	if matchAny(s.ignorePatterns, relPath) {
+		return true
+	}
+
+	if s.IgnoreHidden {
+		for _, name := range strings.Split(relPath, "/") {
+			for _, pattern := range DefaultIgnorePatterns {
+				if ok, err := filepath.Match(pattern, name); ok || err != nil {
+					return true
 				}
 			}
+		}
+	}
 
-			s.FilesMap[relPath] = &StaticFile{
-				Path:           path,
-				RelPath:        relPath,
-				StoragePath:    storagePath,
-				StorageRelPath: strings.TrimPrefix(storagePath, s.OutputDir),
-			}
-			return nil
-		})
+	return false
+}
 
-		if err != nil {
-			return err
+// matchAny reports whether the path matches any of the glob-style patterns.
+// Malformed patterns match any path.
+func matchAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, err := filepath.Match(pattern, path); ok || err != nil {
+			return true
 		}
 	}
+	return false
+}
 
-	return nil
+// matchAnyPath is like matchAny but the patterns may contain
+// the "**" elements matching any number of directories, see matchPath.
+func matchAnyPath(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if !validPattern(pattern) || matchPath(pattern, path) {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *Storage) postProcessFiles() error {
-	for _, sf := range s.FilesMap {
-		for _, rule := range s.postProcessRules {
-			if s.Verbose {
-				log.Printf("Processing '%s'", sf.RelPath)
-			}
+// readIgnoreFile reads the ignore patterns from the IgnoreFilename file in the dir
+// to be matched with matchAnyPath. Blank lines and lines starting with "#" are skipped.
+// Like in .gitignore, patterns without a slash match the names at any depth, while
+// the other ones match the paths relative to the dir. Patterns ending with a slash
+// are returned in the second list, they match directories only.
+func readIgnoreFile(dir string) (patterns, dirPatterns []string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, IgnoreFilename))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
 
-			err := rule(s, sf)
-			if err != nil {
-				return err
-			}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		dirOnly := strings.HasSuffix(line, "/")
+		line = strings.TrimSuffix(line, "/")
+		if line == "" {
+			continue
+		} else if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+
+		line = strings.TrimPrefix(line, "/")
+		if dirOnly {
+			dirPatterns = append(dirPatterns, line)
+		} else {
+			patterns = append(patterns, line)
 		}
 	}
 
-	return nil
+	return patterns, dirPatterns, nil
 }
 
-// CollectStatic collects files from the Storage.inputDirs (including subdirectories),
-// appends hash sum of each file to its name, applies post-processing rules and
-// copies files and manifest to the Storage.OutputDir directory.
-func (s *Storage) CollectStatic() error {
-	err := os.MkdirAll(s.OutputDir, 0755)
+func (s *Storage) RegisterRule(rule PostProcessRule) {
+	s.RegisterProcessor(rule)
+}
+
+// RegisterTextRule registers the rule to be applied to text files only.
+// Binary files are detected with IsBinary and skipped.
+func (s *Storage) RegisterTextRule(rule PostProcessRule) {
+	s.addRule(postProcessRule{processor: rule, textOnly: true})
+}
+
+// RegisterRuleForPattern registers the rule to be applied only to the files
+// whose relative path matches the glob-style pattern. Besides the filepath.Match
+// syntax, the "**" path element matches any number of directories,
+// e.g. "vendor/**/*.css" matches both "vendor/style.css" and "vendor/lib/css/style.css".
+func (s *Storage) RegisterRuleForPattern(pattern string, rule PostProcessRule) {
+	s.addRule(postProcessRule{processor: rule, pattern: pattern})
+}
+
+// RegisterConcurrentRule registers the rule safe to be applied to the different
+// files in parallel when Storage.Workers is greater than one. Such rule may read
+// the Storage.FilesMap and modify its own file only. The rules registered in
+// other ways are applied exclusively.
+func (s *Storage) RegisterConcurrentRule(rule PostProcessRule) {
+	s.addRule(postProcessRule{processor: rule, concurrent: true})
+}
+
+// RegisterGlobalRule registers the rule applied once after all files are
+// processed by the per-file rules. Global rules are applied in the order of registration.
+func (s *Storage) RegisterGlobalRule(rule GlobalRule) {
+	s.globalRules = append(s.globalRules, rule)
+}
+
+// RegisterProcessor registers the processor. Processors and rules
+// are applied in the order of registration unless registered with a priority.
+func (s *Storage) RegisterProcessor(processor Processor) {
+	s.addRule(postProcessRule{processor: processor})
+}
+
+// RegisterRuleWithPriority registers the rule applied in the order of the priority,
+// the lower first, e.g. a minifier with a positive priority runs after PostProcessCSS.
+// Rules registered in other ways have zero priority. Rules with the same priority
+// are applied in the order of registration.
+func (s *Storage) RegisterRuleWithPriority(rule PostProcessRule, priority int) {
+	s.addRule(postProcessRule{processor: rule, priority: priority})
+}
+
+// AddTransform registers the transform applied to the content of the files with
+// the extension, e.g. ".css", when they are collected. Unlike the post-processing rules
+// applied to the storage files after hashing, transforms are applied before, so
+// the storage file names reflect the transformed content. Transforms are applied
+// in the order of registration. They must be deterministic, since the rules like
+// PostProcessCSS and Fingerprint read the source files transformed once again.
+func (s *Storage) AddTransform(ext string, fn func([]byte) ([]byte, error)) {
+	s.transforms = append(s.transforms, transform{ext: strings.ToLower(ext), transform: fn})
+}
+
+// fileTransforms returns the transforms registered for the extension of the file with the path.
+func (s *Storage) fileTransforms(path string) []Transform {
+	var transforms []Transform
+	ext := strings.ToLower(s.fileExt(path))
+	for _, t := range s.transforms {
+		if t.ext == ext {
+			transforms = append(transforms, t.transform)
+		}
+	}
+	return transforms
+}
+
+// readSource reads the source file with the path and applies the transforms to its content.
+func (s *Storage) readSource(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	for _, transform := range s.fileTransforms(path) {
+		content, err = transform(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// openSource opens the source file with the path, the content is transformed
+// if there are transforms registered for it.
+func (s *Storage) openSource(path string) (io.ReadCloser, error) {
+	if len(s.fileTransforms(path)) == 0 {
+		return os.Open(path)
 	}
 
-	err = s.collectFiles()
+	content, err := s.readSource(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// transformFile writes the transformed content of the file with the path to a temporary
+// file with the same name and returns its path, so the file is hashed and copied
+// as usual. The path itself is returned if there are no transforms registered for the file.
+// Temporary files are kept until the collection is finished, see removeTransformDir.
+func (s *Storage) transformFile(path string) (string, error) {
+	if len(s.fileTransforms(path)) == 0 {
+		return path, nil
 	}
 
-	err = s.postProcessFiles()
+	content, err := s.readSource(path)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = saveManifest(s.OutputDir, s.FilesMap)
+	if s.transformDir == "" {
+		s.transformDir, err = ioutil.TempDir(s.TempDir, "staticfiles-transform")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dir, err := ioutil.TempDir(s.transformDir, "")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	src := filepath.ToSlash(filepath.Join(dir, filepath.Base(path)))
+	return src, ioutil.WriteFile(src, content, 0644)
 }
 
-// Open implements http.FileSystem interface to be used primarily in http.FileServer
-func (s *Storage) Open(path string) (http.File, error) {
-	var f http.File
-	var err error
+// removeTransformDir removes the temporary files written by transformFile.
+func (s *Storage) removeTransformDir() {
+	if s.transformDir != "" {
+		os.RemoveAll(s.transformDir)
+		s.transformDir = ""
+	}
+}
 
-	if !s.Enabled {
-		log.Print("Static storage is disabled. Don't forget to enable it in production.")
+// addRule inserts the rule after the rules with the lower or the same priority.
+func (s *Storage) addRule(rule postProcessRule) {
+	i := sort.Search(len(s.postProcessRules), func(i int) bool {
+		return s.postProcessRules[i].priority > rule.priority
+	})
 
-		for _, dir := range s.inputDirs {
-			f, err = http.Dir(dir).Open(path)
-			if (err == nil) || !os.IsNotExist(err) {
-				break
-			}
+	s.postProcessRules = append(s.postProcessRules, postProcessRule{})
+	copy(s.postProcessRules[i+1:], s.postProcessRules[i:])
+	s.postProcessRules[i] = rule
+}
+
+// hashedName returns the path with the formatted hash sum inserted before the file extension
+// or appended to the names without extension, e.g. "LICENSE" or ".htaccess".
+func (s *Storage) hashedName(path, hash string) string {
+	ext := s.fileExt(path)
+	prefix := strings.TrimSuffix(path, ext)
+
+	return prefix + "." + hash + ext
+}
+
+// compoundExtensions returns the Storage.CompoundExtensions
+// or the DefaultCompoundExtensions if the former is nil.
+func (s *Storage) compoundExtensions() []string {
+	if s.CompoundExtensions == nil {
+		return DefaultCompoundExtensions
+	}
+	return s.CompoundExtensions
+}
+
+// fileExt returns the file name extension taking into account
+// the compound extensions, e.g. ".tar.gz".
+func (s *Storage) fileExt(path string) string {
+	base := filepath.Base(path)
+	for _, ext := range s.compoundExtensions() {
+		if len(base) > len(ext) && strings.HasSuffix(strings.ToLower(base), strings.ToLower(ext)) {
+			return base[len(base)-len(ext):]
 		}
-	} else {
-		f, err = s.outputDirFS.Open(path)
 	}
+	return nameExt(path)
+}
 
-	if err != nil {
-		return nil, err
+// hashReader returns the hash sum of the content read from r
+// formatted as in the storage file names.
+func (s *Storage) hashReader(r io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
 	}
 
-	if !s.OutputDirList {
-		stat, err := f.Stat()
-		if err != nil {
-			return nil, err
-		}
+	return s.formatHash(hash.Sum(nil)), nil
+}
 
-		if stat.IsDir() {
-			return nil, os.ErrNotExist
+// storageName returns the storage file name of the file with the content hash sum.
+// It's "<name>.<hash>.<ext>" or "<hash>.<ext>" in the Storage.ContentAddressed mode.
+func (s *Storage) storageName(path string, sum []byte) string {
+	return s.storageNameN(path, sum, s.hashChars())
+}
+
+// storageNameN is like storageName but with the hash sum of n characters.
+func (s *Storage) storageNameN(path string, sum []byte, n int) string {
+	if s.ContentAddressed {
+		return s.formatHashN(sum, n) + s.fileExt(path)
+	}
+	return filepath.Base(s.hashedName(path, s.formatHashN(sum, n)))
+}
+
+// hashChars returns the number of the hash sum characters in the storage file names.
+func (s *Storage) hashChars() int {
+	if s.HashLength > 0 {
+		return s.HashLength
+	}
+
+	switch s.HashEncoding {
+	case Base32:
+		return base32HashLength
+	case Base62:
+		return base62HashLength
+	}
+	return hashLength
+}
+
+// formatHash returns the hash sum as used in the storage file names
+// encoded with the Storage.HashEncoding.
+func (s *Storage) formatHash(sum []byte) string {
+	return s.formatHashN(sum, s.hashChars())
+}
+
+// formatHashN is like formatHash but returns n characters of the encoded
+// hash sum or the whole encoded hash sum if it's shorter.
+func (s *Storage) formatHashN(sum []byte, n int) string {
+	encoded := s.encodeHash(sum)
+	if n > len(encoded) {
+		n = len(encoded)
+	}
+
+	// Leading base62 digits aren't distributed uniformly, so the trailing ones are used
+	if s.HashEncoding == Base62 {
+		return encoded[len(encoded)-n:]
+	}
+	return encoded[:n]
+}
+
+// encodeHash returns the whole hash sum encoded with the Storage.HashEncoding.
+func (s *Storage) encodeHash(sum []byte) string {
+	switch s.HashEncoding {
+	case Base32:
+		return strings.ToLower(base32Encoding.EncodeToString(sum))
+	case Base62:
+		encoded := new(big.Int).SetBytes(sum).Text(62)
+		width := len(new(big.Int).Lsh(big.NewInt(1), uint(len(sum)*8)).Text(62))
+		if len(encoded) < width {
+			encoded = strings.Repeat("0", width-len(encoded)) + encoded
 		}
+		return encoded
 	}
+	return hex.EncodeToString(sum)
+}
 
-	return f, nil
+// hashAndCopy reads the src file once, hashing its content while copying it
+// to a temporary file in the dstDir. The temporary file is then renamed to
+// the hashed file name unless the file with that name already exists.
+// If the name has already been taken by a file with the different content
+// (see hashedStoragePath), the hash sum in the name is extended by one
+// character at a time until the name is unique.
+// It returns the storage file path and whether the file was copied.
+func (s *Storage) hashAndCopy(src, dstDir string, inFlight map[string]string) (string, bool, error) {
+	dst, _, copied, err := s.hashAndCopySum(src, dstDir, "", inFlight)
+	return dst, copied, err
 }
 
-// Resolve returns relative storage file path from the relative original file path.
-// When storage is disabled it returns unchanged value passed in the function.
-func (s *Storage) Resolve(relPath string) string {
-	if !s.Enabled {
-		return relPath
-	} else if sf, ok := s.FilesMap[relPath]; ok {
-		return sf.StorageRelPath
+// hashAndCopySum is like hashAndCopy but returns the content hash sum as well.
+// The prev is the storage file path of the same original file from the previous
+// collection, which is reused regardless of its content, e.g. post-processed.
+func (s *Storage) hashAndCopySum(src, dstDir, prev string, inFlight map[string]string) (string, []byte, bool, error) {
+	if s.linksEnabled() {
+		dst, sum, copied, ok, err := s.hashAndLink(src, dstDir, prev, inFlight)
+		if ok || err != nil {
+			return dst, sum, copied, err
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	// Local files are staged next to the storage files to be renamed to them
+	backend := s.outputBackend()
+	_, local := backend.(FileBackend)
+	tmpDir := s.TempDir
+	if tmpDir == "" && local {
+		tmpDir = dstDir
+	}
+
+	tmp, err := ioutil.TempFile(tmpDir, ".staticfiles-*")
+	if err != nil {
+		return "", nil, false, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hash := md5.New()
+	err = copyContent(tmp, io.TeeReader(in, hash), stat.Size())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	sum := hash.Sum(nil)
+	dst, err := s.hashedStoragePath(src, dstDir, prev, sum, inFlight)
+	if err != nil {
+		return "", sum, false, err
+	}
+
+	if exists, err := backend.Exists(dst); exists || err != nil {
+		return dst, sum, false, err
+	}
+
+	// Other backends get the content of the temporary file
+	if !local {
+		tmp, err = os.Open(tmpPath)
+		if err != nil {
+			return "", sum, false, err
+		}
+		defer tmp.Close()
+
+		return dst, sum, true, s.writeOutput(dst, tmp, stat.Size())
+	}
+
+	err = os.Chmod(tmpPath, 0644)
+	if err != nil {
+		return "", sum, false, err
+	}
+
+	err = os.Rename(tmpPath, dst)
+	if err != nil {
+		return "", sum, false, err
+	}
+
+	return dst, sum, true, nil
+}
+
+// hashedStoragePath returns the path of the storage file with the hashed name
+// in the dstDir. If the name has already been taken during this collection by a file
+// with the different content (see checkCollision) or by the local file left from
+// the previous builds with the content differing from the src one, the hash sum
+// in the name is extended by one character at a time until the name is unique.
+// The prev storage file path of the same original file is reused as is.
+func (s *Storage) hashedStoragePath(src, dstDir, prev string, sum []byte, inFlight map[string]string) (string, error) {
+	var dst string
+	var err error
+	for n := s.hashChars(); ; n++ {
+		dst = filepath.ToSlash(filepath.Join(dstDir, s.storageNameN(src, sum, n)))
+		err = checkCollision(inFlight, dst, src)
+		if err == nil && dst != prev {
+			err = s.checkStaleCollision(dst, src, sum)
+		}
+		if _, ok := err.(*StoragePathCollisionError); !ok || n >= len(s.encodeHash(sum)) {
+			break
+		}
+	}
+	return dst, err
+}
+
+// checkStaleCollision returns StoragePathCollisionError if the local storage file
+// with the path exists and its content differs from the src file one with the sum.
+// Files of the other backends can't be read, so they aren't checked.
+func (s *Storage) checkStaleCollision(storagePath, src string, sum []byte) error {
+	if _, ok := s.outputBackend().(FileBackend); !ok {
+		return nil
+	}
+
+	stat, err := os.Stat(storagePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() == srcStat.Size() {
+		f, err := os.Open(storagePath)
+		if err != nil {
+			return err
+		}
+
+		hash := md5.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(hash.Sum(nil), sum) {
+			return nil
+		}
+	}
+
+	return &StoragePathCollisionError{StoragePath: storagePath, Paths: [2]string{storagePath, src}}
+}
+
+// hashAndLink is like hashAndCopySum but hashes the src file first and hard links it
+// to the hashed file name with the Storage.UseHardLinks. It reports false if the link
+// can't be created, so the file is copied instead.
+func (s *Storage) hashAndLink(src, dstDir, prev string, inFlight map[string]string) (dst string, sum []byte, copied, ok bool, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", nil, false, false, err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(hash, in)
+	in.Close()
+	if err != nil {
+		return "", nil, false, false, err
+	}
+
+	sum = hash.Sum(nil)
+	dst, err = s.hashedStoragePath(src, dstDir, prev, sum, inFlight)
+	if err != nil {
+		return "", sum, false, false, err
+	}
+
+	if _, err = os.Stat(dst); err == nil {
+		return dst, sum, false, true, nil
+	} else if !os.IsNotExist(err) {
+		return "", sum, false, false, err
+	}
+
+	ok, err = linkFile(src, dst)
+	return dst, sum, ok, ok, err
+}
+
+// linksEnabled reports whether the storage files are hard linked to the source ones,
+// which is possible with the local files only.
+func (s *Storage) linksEnabled() bool {
+	_, ok := s.outputBackend().(FileBackend)
+	return s.UseHardLinks && ok
+}
+
+// linkFile replaces the dst file with the hard link to the src file. It reports false
+// if the link can't be created, e.g. across the file systems.
+func linkFile(src, dst string) (bool, error) {
+	err := os.Remove(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return os.Link(src, dst) == nil, nil
+}
+
+// writeStorageFile replaces the content of the storage file with the Storage.OutputBackend.
+// Local files are removed first, so the source file hard linked to it with
+// the Storage.UseHardLinks is left intact.
+func (s *Storage) writeStorageFile(path string, content []byte) error {
+	if _, ok := s.outputBackend().(FileBackend); !ok {
+		return s.writeOutput(path, bytes.NewReader(content), int64(len(content)))
+	}
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// copyContent copies data from src to dst and verifies that
+// exactly size bytes were written.
+func copyContent(dst io.Writer, src io.Reader, size int64) error {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+
+	if n != size {
+		return ErrCopySizeMismatch
+	}
+
+	return nil
+}
+
+func (s *Storage) copyFile(src, dst string) error {
+	return s.copyFileTee(src, dst, nil)
+}
+
+// copyFileTee copies the src file to the dst with the Storage.OutputBackend
+// writing the copied content to the tee as well if it's not nil.
+// With the Storage.UseHardLinks the dst file is hard linked to the src one if possible.
+func (s *Storage) copyFileTee(src, dst string, tee io.Writer) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if s.linksEnabled() {
+		linked, err := linkFile(src, dst)
+		if err != nil {
+			return err
+		}
+
+		if linked {
+			if tee != nil {
+				_, err = io.Copy(tee, in)
+			}
+			return err
+		}
+	} else if _, local := s.outputBackend().(FileBackend); local {
+		// Truncating the file linked by the previous collection would clear the source
+		if dstStat, err := os.Stat(dst); err == nil && os.SameFile(stat, dstStat) {
+			err = os.Remove(dst)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var r io.Reader = in
+	if tee != nil {
+		r = io.TeeReader(in, tee)
+	}
+
+	return s.writeOutput(dst, r, stat.Size())
+}
+
+// StoragePathCollisionError is returned when different source files
+// are about to be written to the same storage path.
+type StoragePathCollisionError struct {
+	StoragePath string
+	Paths       [2]string // source file paths
+}
+
+func (e *StoragePathCollisionError) Error() string {
+	return fmt.Sprintf("storage path '%s' collision: '%s' and '%s' differ", e.StoragePath, e.Paths[0], e.Paths[1])
+}
+
+// MaxDepthError is returned when the input directory is nested deeper than
+// the Storage.MaxDepth, e.g. due to an accidentally recursive tree.
+type MaxDepthError struct {
+	Path     string // path of the directory exceeding the limit
+	MaxDepth int
+}
+
+func (e *MaxDepthError) Error() string {
+	return fmt.Sprintf("directory '%s' exceeds the maximum depth %d", e.Path, e.MaxDepth)
+}
+
+// checkDepth returns MaxDepthError if the directory with the path relative
+// to the input directory is nested deeper than the Storage.MaxDepth.
+func (s *Storage) checkDepth(path, relDir string) error {
+	relDir = strings.Trim(relDir, "/")
+	if s.MaxDepth <= 0 || relDir == "" || relDir == "." {
+		return nil
+	}
+
+	if strings.Count(relDir, "/")+1 > s.MaxDepth {
+		return &MaxDepthError{Path: path, MaxDepth: s.MaxDepth}
+	}
+	return nil
+}
+
+// checkCollision returns StoragePathCollisionError if the storagePath has already been
+// written during the collection from a source file with the content differing from the path one.
+func checkCollision(inFlight map[string]string, storagePath, path string) error {
+	prevPath, ok := inFlight[storagePath]
+	if !ok || prevPath == path {
+		return nil
+	}
+
+	equal, err := filesEqual(prevPath, path)
+	if err != nil {
+		return err
+	}
+
+	if !equal {
+		return &StoragePathCollisionError{StoragePath: storagePath, Paths: [2]string{prevPath, path}}
+	}
+	return nil
+}
+
+// updateVersion derives the version with the Storage.VersionFunc if it's set.
+func (s *Storage) updateVersion() error {
+	if s.VersionFunc == nil {
+		return nil
+	}
+
+	version, err := s.VersionFunc()
+	if err != nil {
+		return err
+	}
+
+	version = path.Clean(normalizeSlashes(version))
+	if version == "." || version == ".." || strings.HasPrefix(version, "../") || path.IsAbs(version) {
+		return ErrInvalidVersion
+	}
+
+	s.filesLock.Lock()
+	s.version = version
+	s.filesLock.Unlock()
+	return nil
+}
+
+// versionSegment returns the Storage.VersionSegment followed by the version
+// derived with the Storage.VersionFunc.
+func (s *Storage) versionSegment() string {
+	if s.VersionFunc == nil {
+		return s.VersionSegment
+	}
+	return path.Join(s.VersionSegment, s.version)
+}
+
+// storageDir returns the directory of the storage file with the original relative path.
+func (s *Storage) storageDir(relPath string) string {
+	if s.ContentAddressed {
+		return filepath.Join(s.OutputDir, s.versionSegment())
+	}
+	return filepath.Join(s.OutputDir, s.versionSegment(), filepath.Dir(relPath))
+}
+
+// collectFiles collects the files of the input directories into the new map
+// of the original relative paths to the files. The Storage.FilesMap isn't changed,
+// the storage paths of its files are reused only, see hashAndCopySum.
+func (s *Storage) collectFiles() (map[string]*StaticFile, error) {
+	// Storage paths written during this collection mapped to the source file paths
+	inFlight := make(map[string]string)
+	filesMap := make(map[string]*StaticFile)
+	defer s.removeTransformDir()
+
+	for _, dir := range s.inputDirs {
+		patterns, dirPatterns, err := readIgnoreFile(dir)
+		if err != nil {
+			return nil, err
+		}
+		dirPatterns = append(dirPatterns, patterns...)
+
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				relPath := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path))+"/", dir)
+				if relPath != "" && (matchAnyPath(dirPatterns, strings.TrimSuffix(relPath, "/")) ||
+					s.isIgnored(s.inputPrefixes[dir]+strings.TrimSuffix(relPath, "/"))) {
+					return filepath.SkipDir
+				}
+
+				ignored, err := s.isIgnoredDir(path)
+				if ignored {
+					return filepath.SkipDir
+				} else if err != nil {
+					return err
+				}
+
+				if err = s.checkDepth(path, relPath); err != nil {
+					return err
+				}
+
+				// Directories are flattened in the content addressed storage
+				if s.PreserveEmptyDirs && !s.ContentAddressed {
+					return s.preserveEmptyDir(path, filepath.Join(s.OutputDir, s.versionSegment(), s.inputPrefixes[dir], relPath))
+				}
+				return nil
+			}
+
+			_, err = s.collectFile(dir, path, info, patterns, inFlight, filesMap)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filesMap, nil
+}
+
+// preserveEmptyDir creates the storage directory of the input directory with the path
+// with the Storage.OutputBackend if the input directory is empty, see Storage.PreserveEmptyDirs.
+func (s *Storage) preserveEmptyDir(path, storageDir string) error {
+	empty, err := isEmptyDir(path)
+	if err != nil || !empty {
+		return err
+	}
+
+	backend, ok := s.outputBackend().(DirBackend)
+	if !ok {
+		return &UnsupportedOptionError{Option: "PreserveEmptyDirs"}
+	}
+	return backend.MkdirAll(storageDir)
+}
+
+// collectFile copies the file with the path from the input directory dir to the storage
+// and adds it to the filesMap. It returns nil if the file is skipped.
+func (s *Storage) collectFile(dir, path string, info os.FileInfo, patterns []string, inFlight map[string]string, filesMap map[string]*StaticFile) (*StaticFile, error) {
+	var err error
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		// Symlinks are hashed and copied by the content of their targets,
+		// so the links to the same file get the same hash
+		info, err = os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Symlinked directories aren't followed
+		if info.IsDir() {
+			return nil, nil
+		}
+	}
+
+	path = filepath.ToSlash(path)
+	dirRelPath := strings.TrimPrefix(path, dir)
+	relPath := s.inputPrefixes[dir] + dirRelPath
+	if dirRelPath == IgnoreFilename || isManifestFile(path) || matchAnyPath(patterns, dirRelPath) || s.isIgnored(relPath) {
+		return nil, nil
+	}
+
+	if s.MaxFileSize > 0 && info.Size() > s.MaxFileSize {
+		if s.Verbose {
+			log.Printf("Skipping '%s': size %d exceeds %d bytes", relPath, info.Size(), s.MaxFileSize)
+		}
+
+		// Drop the entry loaded from the previous manifest
+		delete(filesMap, relPath)
+		return nil, nil
+	}
+
+	storageDir := s.storageDir(relPath)
+	err = s.mkdirAll(storageDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Content is read from the transformed copy of the file, if any
+	src, err := s.transformFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var storagePath, hashSum string
+	var sum []byte
+	var copied bool
+
+	pinnedName, pinned := s.pinnedName(relPath)
+	if pinned {
+		// Pinned file content may change while its name doesn't,
+		// so the file is always copied.
+		storagePath = filepath.ToSlash(filepath.Join(storageDir, pinnedName))
+		err = checkCollision(inFlight, storagePath, src)
+		if err == nil {
+			hash := md5.New()
+			err = s.copyFileTee(src, storagePath, hash)
+			sum = hash.Sum(nil)
+			copied = true
+		}
+	} else if s.QueryStringMode || s.versionSegment() != "" {
+		// Files keep the original names, so they are always copied
+		storagePath = filepath.ToSlash(filepath.Join(storageDir, filepath.Base(path)))
+		err = checkCollision(inFlight, storagePath, src)
+		if err == nil {
+			hash := md5.New()
+			err = s.copyFileTee(src, storagePath, hash)
+			sum = hash.Sum(nil)
+			if s.QueryStringMode {
+				hashSum = s.formatHash(sum)
+			}
+			copied = true
+		}
+	} else {
+		var prev string
+		if prevFile, ok := s.FilesMap[relPath]; ok {
+			prev = filepath.ToSlash(filepath.Join(s.OutputDir, prevFile.StorageRelPath))
+		}
+		storagePath, sum, copied, err = s.hashAndCopySum(src, storageDir, prev, inFlight)
+	}
+	if err != nil {
+		return nil, err
+	}
+	inFlight[storagePath] = src
+
+	if copied && s.Verbose {
+		log.Printf("Copied '%s'", relPath)
+	}
+
+	var contentType string
+	if s.RecordContentType {
+		contentType, err = detectContentType(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var contentHash string
+	if s.RecordContentHash {
+		contentHash = hex.EncodeToString(sum)
+	}
+
+	var modTime time.Time
+	if s.RecordModTime {
+		modTime = info.ModTime().UTC()
+	}
+
+	sf := &StaticFile{
+		Path:           path,
+		RelPath:        relPath,
+		StoragePath:    storagePath,
+		StorageRelPath: strings.TrimPrefix(storagePath, s.OutputDir),
+		CacheControl:   s.matchCachePolicy(relPath),
+		Pinned:         pinned,
+		Hash:           hashSum,
+		ContentHash:    contentHash,
+		ContentType:    contentType,
+		ModTime:        modTime,
+	}
+	filesMap[relPath] = sf
+
+	if s.OnFileCollected != nil {
+		if err = s.OnFileCollected(sf); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+// postProcessFiles sets up the processors in the order they are applied,
+// processes the files, applies the global rules and tears the processors
+// down in the reverse order.
+func (s *Storage) postProcessFiles(files []*StaticFile) (err error) {
+	for i, r := range s.postProcessRules {
+		if err = r.processor.Setup(s); err != nil {
+			s.teardownProcessors(i)
+			return err
+		}
+	}
+
+	defer func() {
+		if teardownErr := s.teardownProcessors(len(s.postProcessRules)); err == nil {
+			err = teardownErr
+		}
+	}()
+
+	if s.rehashesCSS() {
+		files, err = orderByImports(s, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Files added by the rules are processed in the subsequent passes
+	for len(files) > 0 {
+		// CSS files are processed after the other ones, so the references in them
+		// get the final names of the files renamed by the rules, e.g. the optimized images
+		cssFiles, others := partitionCSS(files)
+		for _, batch := range [][]*StaticFile{others, cssFiles} {
+			err = s.processFiles(batch)
+			if err != nil {
+				return err
+			}
+		}
+
+		files = s.pendingFiles
+		s.pendingFiles = nil
+
+		s.filesLock.Lock()
+		for _, sf := range files {
+			s.FilesMap[sf.RelPath] = sf
+		}
+		s.resetIndexes()
+		s.filesLock.Unlock()
+	}
+
+	for _, rule := range s.globalRules {
+		if err = rule(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// partitionCSS splits the files into the CSS files and the other ones keeping their order.
+func partitionCSS(files []*StaticFile) (cssFiles, others []*StaticFile) {
+	for _, sf := range files {
+		if filepath.Ext(sf.Path) == ".css" {
+			cssFiles = append(cssFiles, sf)
+		} else {
+			others = append(others, sf)
+		}
+	}
+	return cssFiles, others
+}
+
+// teardownProcessors tears down the first n processors in the reverse order
+// and returns the first error occurred.
+func (s *Storage) teardownProcessors(n int) error {
+	var firstErr error
+	for i := n - 1; i >= 0; i-- {
+		if err := s.postProcessRules[i].processor.Teardown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// processFiles applies the rules to the files serially or using
+// the Storage.Workers goroutines. In the latter case the concurrent rules
+// run in parallel, while the other ones run exclusively.
+func (s *Storage) processFiles(files []*StaticFile) error {
+	if s.Workers <= 1 || s.rehashesCSS() {
+		for _, sf := range files {
+			if err := s.processFile(sf, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var lock sync.RWMutex
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	jobs := make(chan *StaticFile)
+	done := make(chan struct{})
+
+	for i := 0; i < s.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sf := range jobs {
+				if err := s.processFile(sf, &lock); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						close(done)
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, sf := range files {
+		select {
+		case jobs <- sf:
+		case <-done:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// processFile applies the rules to the file in the order of priority and registration.
+// When the lock is given, the concurrent rules hold it for reading
+// and the other ones hold it for writing.
+func (s *Storage) processFile(sf *StaticFile, lock *sync.RWMutex) error {
+	if s.isNoProcess(sf.RelPath) {
+		return nil
+	}
+
+	binaryChecked, binary := false, false
+
+	for _, r := range s.postProcessRules {
+		if r.pattern != "" && !matchPath(r.pattern, sf.RelPath) {
+			continue
+		}
+
+		if r.textOnly {
+			if sf.Path == "" {
+				continue
+			}
+
+			if !binaryChecked {
+				var err error
+				binary, err = IsBinary(sf.Path)
+				if err != nil {
+					return err
+				}
+				binaryChecked = true
+			}
+
+			if binary {
+				continue
+			}
+		}
+
+		if s.Verbose {
+			log.Printf("Processing '%s'", sf.RelPath)
+		}
+
+		if lock != nil {
+			if r.concurrent {
+				lock.RLock()
+			} else {
+				lock.Lock()
+			}
+		}
+
+		err := r.processor.Process(s, sf)
+
+		if lock != nil {
+			if r.concurrent {
+				lock.RUnlock()
+			} else {
+				lock.Unlock()
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddProcessedFile writes the content to a new storage file named the same way
+// as the collected file with the original relative path would be. It's intended
+// to be called by the post-process rules generating derived files, e.g. source maps.
+// The file is added to the Storage.FilesMap after the current processing pass
+// and then processed by all the rules too, so the rules must not derive files endlessly.
+// The Path of the added file is its storage file path.
+func (s *Storage) AddProcessedFile(relPath string, content []byte) error {
+	storageDir := s.storageDir(relPath)
+	err := s.mkdirAll(storageDir)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(content)
+	name := s.storageName(relPath, sum[:])
+	var hashSum string
+
+	pinnedName, pinned := s.pinnedName(relPath)
+	if pinned {
+		name = pinnedName
+	} else if s.QueryStringMode || s.versionSegment() != "" {
+		name = filepath.Base(relPath)
+		if s.QueryStringMode {
+			hashSum = s.formatHash(sum[:])
+		}
+	}
+
+	storagePath := filepath.ToSlash(filepath.Join(storageDir, name))
+	err = s.writeStorageFile(storagePath, content)
+	if err != nil {
+		return err
+	}
+
+	var contentType string
+	if s.RecordContentType {
+		contentType = contentTypeOf(storagePath, content)
+	}
+
+	var contentHash string
+	if s.RecordContentHash {
+		contentHash = hex.EncodeToString(sum[:])
+	}
+
+	s.pendingLock.Lock()
+	s.pendingFiles = append(s.pendingFiles, &StaticFile{
+		Path:           storagePath,
+		RelPath:        relPath,
+		StoragePath:    storagePath,
+		StorageRelPath: strings.TrimPrefix(storagePath, s.OutputDir),
+		CacheControl:   s.matchCachePolicy(relPath),
+		Pinned:         pinned,
+		Hash:           hashSum,
+		ContentHash:    contentHash,
+		ContentType:    contentType,
+	})
+	s.pendingLock.Unlock()
+
+	return nil
+}
+
+func (s *Storage) mirrorFiles() error {
+	for _, mirrorDir := range s.outputMirrors {
+		for _, sf := range s.FilesMap {
+			src := filepath.Join(s.OutputDir, sf.StorageRelPath)
+			dst := filepath.Join(mirrorDir, sf.StorageRelPath)
+
+			err := s.mkdirAll(filepath.Dir(dst))
+			if err != nil {
+				return err
+			}
+
+			if s.Verbose {
+				log.Printf("Mirroring '%s' to '%s'", sf.StorageRelPath, mirrorDir)
+			}
+
+			err = s.copyFile(src, dst)
+			if err != nil {
+				return err
+			}
+
+			for _, ext := range compressedExtensions {
+				if _, err := os.Stat(src + ext); err == nil {
+					err = s.copyFile(src+ext, dst+ext)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			if sf.LatestRelPath != "" {
+				latestDst := filepath.Join(mirrorDir, sf.LatestRelPath)
+				err = s.mkdirAll(filepath.Dir(latestDst))
+				if err == nil {
+					err = s.copyFile(filepath.Join(s.OutputDir, sf.LatestRelPath), latestDst)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err := s.saveManifest(mirrorDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkWritable creates the directory if it doesn't exist and makes sure
+// the files can be written to it. It returns ErrOutputNotWritable
+// if the directory or a file in it can't be created.
+func checkWritable(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		if isNotWritable(err) {
+			return ErrOutputNotWritable
+		}
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".staticfiles-*")
+	if err != nil {
+		return ErrOutputNotWritable
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// isNotWritable reports whether the error is caused by
+// the lack of permissions or a read-only filesystem.
+func isNotWritable(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return os.IsPermission(err) || err == syscall.EROFS
+}
+
+// CollectStatic collects files from the Storage.inputDirs (including subdirectories),
+// appends hash sum of each file to its name, applies post-processing rules and
+// copies files and manifest to the Storage.OutputDir directory and its mirrors.
+func (s *Storage) CollectStatic() error {
+	s.buildLock.Lock()
+	defer s.buildLock.Unlock()
+
+	err := s.checkOutput()
+	if err != nil {
+		return err
+	}
+
+	err = s.updateVersion()
+	if err != nil {
+		return err
+	}
+
+	prevPaths := s.storagePaths()
+	prevResolvedPaths := resolvedPaths(s.FilesMap)
+
+	filesMap, err := s.collectFiles()
+	if err != nil {
+		return err
+	}
+
+	files := make([]*StaticFile, 0, len(filesMap))
+	for _, sf := range filesMap {
+		files = append(files, sf)
+	}
+	s.setFilesMap(filesMap)
+
+	err = s.finishCollecting(files)
+	if err != nil {
+		return err
+	}
+
+	if s.WriteChangeLog {
+		err = s.saveChangeLog(prevResolvedPaths)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.RemoveStale {
+		return s.removeStale(prevPaths)
+	}
+	return nil
+}
+
+// CollectOnce runs the CollectStatic on the first call and returns its error
+// on the subsequent ones without collecting the files again, e.g. to collect
+// on startup or on each request in development from the same process serving the files.
+// Use the ForceCollect to collect the files regardless.
+func (s *Storage) CollectOnce() error {
+	s.collectOnce.Do(func() {
+		s.setCollectErr(s.CollectStatic())
+	})
+
+	s.collectLock.Lock()
+	defer s.collectLock.Unlock()
+	return s.collectErr
+}
+
+// ForceCollect runs the CollectStatic even if the files have been collected already.
+// The subsequent CollectOnce calls don't collect the files and return its error.
+func (s *Storage) ForceCollect() error {
+	s.collectOnce.Do(func() {})
+
+	err := s.CollectStatic()
+	s.setCollectErr(err)
+	return err
+}
+
+func (s *Storage) setCollectErr(err error) {
+	s.collectLock.Lock()
+	defer s.collectLock.Unlock()
+	s.collectErr = err
+}
+
+// setFilesMap replaces the Storage.FilesMap with the collected or loaded one.
+func (s *Storage) setFilesMap(filesMap map[string]*StaticFile) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.FilesMap = filesMap
+	s.resetIndexes()
+}
+
+// copyFilesMap returns the copy of the Storage.FilesMap to merge the collected files into,
+// so the concurrent readers don't see the map changing during the collection.
+func (s *Storage) copyFilesMap() map[string]*StaticFile {
+	filesMap := make(map[string]*StaticFile, len(s.FilesMap))
+	for relPath, sf := range s.FilesMap {
+		filesMap[relPath] = sf
+	}
+	return filesMap
+}
+
+// storagePaths returns the set of the storage relative paths of
+// the Storage.FilesMap files, their compressed and latest copies.
+func (s *Storage) storagePaths() map[string]bool {
+	paths := make(map[string]bool, (2+len(compressedExtensions))*len(s.FilesMap))
+	for _, sf := range s.FilesMap {
+		paths[sf.StorageRelPath] = true
+		for _, ext := range compressedExtensions {
+			paths[sf.StorageRelPath+ext] = true
+		}
+		if sf.LatestRelPath != "" {
+			paths[sf.LatestRelPath] = true
+		}
+	}
+	return paths
+}
+
+// removeStale removes the storage files with the previous paths
+// which are no longer used by the Storage.FilesMap.
+func (s *Storage) removeStale(prevPaths map[string]bool) error {
+	currentPaths := s.storagePaths()
+
+	stalePaths := make([]string, 0, len(prevPaths))
+	for storageRelPath := range prevPaths {
+		if !currentPaths[storageRelPath] {
+			stalePaths = append(stalePaths, storageRelPath)
+		}
+	}
+	sort.Strings(stalePaths)
+
+	for _, storageRelPath := range stalePaths {
+		err := s.removeOutputFile(storageRelPath)
+		if err != nil {
+			return err
+		}
+
+		if s.Verbose {
+			log.Printf("Removed '%s'", storageRelPath)
+		}
+	}
+
+	return nil
+}
+
+// removeOutputFile removes the storage file with the relative path after
+// making sure it's located in the Storage.OutputDir with the symlinks resolved.
+// Missing files are ignored. Symlinks themselves are removed, not their targets.
+func (s *Storage) removeOutputFile(storageRelPath string) error {
+	root, err := filepath.EvalSymlinks(s.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.OutputDir, filepath.FromSlash(storageRelPath))
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	path = filepath.Join(dir, filepath.Base(path))
+	if path == root || !isWithinDir(root, path) {
+		return ErrOutsideOutputDir
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// CollectFiles collects only the files with the paths, e.g. the changed ones
+// reported by an external build tool, and merges them into the Storage.FilesMap
+// loaded from the existing manifest. Each path must be located in one of
+// the input directories, ErrOutsideInputDirs is returned otherwise. Ignored files
+// are skipped. Only the collected files are post-processed, so PostProcessCSS
+// rewrites references to the files collected in the same call only.
+func (s *Storage) CollectFiles(paths []string) error {
+	s.buildLock.Lock()
+	defer s.buildLock.Unlock()
+
+	err := s.checkOutput()
+	if err != nil {
+		return err
+	}
+
+	err = s.updateVersion()
+	if err != nil {
+		return err
+	}
+
+	filesMap := s.copyFilesMap()
+	files, err := s.collectPaths(paths, filesMap)
+	if err != nil {
+		return err
+	}
+	s.setFilesMap(filesMap)
+
+	return s.finishCollecting(files)
+}
+
+// collectPaths collects the files with the paths located in the input directories
+// into the filesMap and returns them. Ignored files and directories are skipped.
+func (s *Storage) collectPaths(paths []string, filesMap map[string]*StaticFile) ([]*StaticFile, error) {
+	inFlight := make(map[string]string)
+	defer s.removeTransformDir()
+	var files []*StaticFile
+
+	for _, path := range paths {
+		dir, relPath, err := s.findInputDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		patterns, dirPatterns, err := readIgnoreFile(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		ignored, err := s.inIgnoredDir(dir, relPath, append(dirPatterns, patterns...))
+		if err != nil {
+			return nil, err
+		} else if ignored {
+			continue
+		}
+
+		path = filepath.Join(dir, relPath)
+		if err = s.checkDepth(filepath.Dir(path), filepath.ToSlash(filepath.Dir(relPath))); err != nil {
+			return nil, err
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		} else if info.IsDir() {
+			continue
+		}
+
+		sf, err := s.collectFile(dir, path, info, patterns, inFlight, filesMap)
+		if err != nil {
+			return nil, err
+		} else if sf != nil {
+			files = append(files, sf)
+		}
+	}
+
+	return files, nil
+}
+
+// findInputDir returns the input directory containing the file with the path
+// and the file path relative to it.
+func (s *Storage) findInputDir(path string) (dir, relPath string, err error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, dir := range s.inputDirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", "", err
+		}
+
+		if isWithinDir(absDir, absPath) {
+			relPath, _ := filepath.Rel(absDir, absPath)
+			return dir, filepath.ToSlash(relPath), nil
+		}
+	}
+
+	return "", "", ErrOutsideInputDirs
+}
+
+// inIgnoredDir reports whether any of the parent directories of the file with
+// the path relative to the input directory dir is ignored while collecting.
+func (s *Storage) inIgnoredDir(dir, relPath string, dirPatterns []string) (bool, error) {
+	for parent := path.Dir(relPath); parent != "."; parent = path.Dir(parent) {
+		if matchAnyPath(dirPatterns, parent) {
+			return true, nil
+		}
+
+		ignored, err := s.isIgnoredDir(filepath.Join(dir, parent))
+		if ignored || err != nil {
+			return ignored, err
+		}
+	}
+	return false, nil
+}
+
+// finishCollecting post-processes and compresses the collected files,
+// saves the manifest and replicates the storage to the mirrors.
+func (s *Storage) finishCollecting(files []*StaticFile) error {
+	err := s.postProcessFiles(files)
+	if err != nil {
+		return err
+	}
+
+	if s.FailOnBrokenReferences {
+		err = checkReferences(s, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.encodings()) > 0 {
+		err = s.compressFiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.VerifyOnOpen {
+		err = s.recordDigests()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.EmitLatestAlias {
+		err = s.writeLatestCopies()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.saveManifest(s.OutputDir)
+	if err != nil {
+		return err
+	}
+
+	err = s.mirrorFiles()
+	if err != nil {
+		return err
+	}
+
+	s.resetIndexes()
+	return nil
+}
+
+// writeLatestCopies copies the post-processed storage files collected
+// in this session to the LatestDir, see Storage.EmitLatestAlias.
+func (s *Storage) writeLatestCopies() error {
+	for _, sf := range s.FilesMap {
+		// Files loaded from the manifest keep their copies
+		if sf.Path == "" {
+			continue
+		}
+
+		latestRelPath := path.Join(LatestDir, sf.RelPath)
+		dst := filepath.Join(s.OutputDir, latestRelPath)
+
+		err := s.mkdirAll(filepath.Dir(dst))
+		if err != nil {
+			return err
+		}
+
+		err = s.copyFile(filepath.Join(s.OutputDir, sf.StorageRelPath), dst)
+		if err != nil {
+			return err
+		}
+
+		s.filesLock.Lock()
+		sf.LatestRelPath = latestRelPath
+		s.filesLock.Unlock()
+	}
+	return nil
+}
+
+// addCloser registers the function releasing resources on Close.
+func (s *Storage) addCloser(closer func() error) {
+	s.closeLock.Lock()
+	s.closers = append(s.closers, closer)
+	s.closeLock.Unlock()
+}
+
+// Close releases the resources held by the storage, e.g. stops the running watchers
+// and waits for them to finish. It calls the release functions in the reverse order
+// of registration and returns the first error occurred. Subsequent calls do nothing.
+func (s *Storage) Close() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var firstErr error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.closers = nil
+
+	return firstErr
+}
+
+// MissingFilesError is returned by Storage.Verify when the storage files
+// listed in the manifest are missing in the Storage.OutputDir.
+type MissingFilesError struct {
+	StorageRelPaths []string // sorted storage relative paths of the missing files
+}
+
+func (e *MissingFilesError) Error() string {
+	return fmt.Sprintf("%d storage files are missing: %s", len(e.StorageRelPaths), strings.Join(e.StorageRelPaths, ", "))
+}
+
+// Verify checks that the storage files of all the Storage.FilesMap entries, e.g. loaded
+// from the manifest, and their latest copies exist in the Storage.OutputDir.
+// It returns MissingFilesError otherwise.
+func (s *Storage) Verify() error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	var missing []string
+	for _, sf := range s.FilesMap {
+		for _, storageRelPath := range []string{sf.StorageRelPath, sf.LatestRelPath} {
+			if storageRelPath == "" {
+				continue
+			}
+
+			stat, err := os.Stat(filepath.Join(s.OutputDir, storageRelPath))
+			if os.IsNotExist(err) || (err == nil && stat.IsDir()) {
+				missing = append(missing, storageRelPath)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &MissingFilesError{StorageRelPaths: missing}
+	}
+	return nil
+}
+
+// Warm reads the storage files of the Storage.FilesMap and their compressed copies
+// to populate the OS page cache, e.g. right after the deploy. It does nothing
+// when the storage is disabled.
+func (s *Storage) Warm() error {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	if !s.Enabled {
+		return nil
+	}
+
+	for _, sf := range s.FilesMap {
+		storagePath := filepath.Join(s.OutputDir, sf.StorageRelPath)
+		if err := warmFile(storagePath); err != nil {
+			return err
+		}
+
+		for _, ext := range compressedExtensions {
+			if err := warmFile(storagePath + ext); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func warmFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(ioutil.Discard, f)
+	return err
+}
+
+// Stats returns the number of files in the Storage.FilesMap and
+// the total size of the corresponding storage files. Storage files
+// which can't be read are not counted in the total size.
+func (s *Storage) Stats() (fileCount int, totalBytes int64) {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	for _, sf := range s.FilesMap {
+		stat, err := os.Stat(filepath.Join(s.OutputDir, sf.StorageRelPath))
+		if err == nil {
+			totalBytes += stat.Size()
+		}
+	}
+
+	return len(s.FilesMap), totalBytes
+}
+
+// Open implements http.FileSystem interface to be used primarily in http.FileServer.
+// Files are returned positioned at the start and seekable, even when verified
+// with the Storage.VerifyOnOpen, so the range requests are served correctly.
+func (s *Storage) Open(name string) (http.File, error) {
+	if !s.Enabled {
+		log.Print("Static storage is disabled. Don't forget to enable it in production.")
+	}
+
+	// "css" and "css/" are the same directory
+	name = path.Clean("/" + name)
+
+	f, err := s.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.OutputDirList || s.IndexFile != "" {
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if stat.IsDir() {
+			if s.IndexFile != "" {
+				index, err := s.openIndexFile(name)
+				if err == nil {
+					f.Close()
+					return index, nil
+				} else if !os.IsNotExist(err) {
+					f.Close()
+					return nil, err
+				}
+			}
+
+			if !s.OutputDirList {
+				f.Close()
+				return nil, os.ErrNotExist
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// openFile opens the file from the storage or from the input directories
+// when the storage is disabled.
+func (s *Storage) openFile(name string) (http.File, error) {
+	if s.Enabled {
+		if s.CleanURLs {
+			if sf, ok := s.findFile(name); ok {
+				name = "/" + sf.StorageRelPath
+			}
+		}
+
+		f, err := s.outputDirFS.Open(name)
+		if err != nil {
+			if s.OpenFallbackToSource && os.IsNotExist(err) {
+				return s.openFallback(name, err)
+			}
+			return nil, err
+		}
+
+		// Unknown files aren't checked
+		sf, ok := s.findStorageFile(path.Clean("/" + name))
+		if !ok {
+			return f, nil
+		}
+
+		if s.VerifyOnOpen {
+			if err = s.verifyFile(&sf, f); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+
+		if !sf.ModTime.IsZero() {
+			return &modTimeFile{File: f, modTime: sf.ModTime}, nil
+		}
+		return f, nil
+	}
+
+	var f http.File
+	err := os.ErrNotExist
+
+	for _, dir := range s.inputDirs {
+		dirName, ok := s.inputRelPath(dir, strings.TrimPrefix(path.Clean("/"+name), "/"))
+		if !ok {
+			continue
+		}
+
+		f, err = http.Dir(dir).Open(dirName)
+		if (err == nil) || !os.IsNotExist(err) {
+			break
+		}
+	}
+
+	return f, err
+}
+
+// openFallback opens the original file of the known storage file with the name
+// missing in the Storage.OutputDir. The err is returned for the unknown files
+// and the files loaded from the manifest, since their source paths are unknown.
+func (s *Storage) openFallback(name string, err error) (http.File, error) {
+	sf, ok := s.findStorageFile(path.Clean("/" + name))
+	if !ok || sf.Path == "" {
+		return nil, err
+	}
+
+	log.Printf("Storage file '%s' is missing, the source file '%s' is served instead", sf.StorageRelPath, sf.Path)
+	f, err := os.Open(sf.Path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// verifyFile checks the content of the opened storage file against its recorded digest.
+// Files without the digest aren't checked.
+func (s *Storage) verifyFile(sf *StaticFile, f http.File) error {
+	if sf.Digest == "" {
+		return nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	verified := verifiedFile{digest: sf.Digest, size: stat.Size(), modTime: stat.ModTime()}
+	if s.isVerified(sf.StorageRelPath, verified) {
+		return nil
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+
+	if s.formatHashN(hash.Sum(nil), len(sf.Digest)) != sf.Digest {
+		return ErrIntegrityMismatch
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.verified == nil {
+		s.verified = make(map[string]verifiedFile)
+	}
+	s.verified[sf.StorageRelPath] = verified
+	return nil
+}
+
+// verifiedFile is the storage file state checked by the Storage.VerifyOnOpen.
+type verifiedFile struct {
+	digest  string
+	size    int64
+	modTime time.Time
+}
+
+// isVerified reports whether the storage file was verified in the same state.
+func (s *Storage) isVerified(storageRelPath string, state verifiedFile) bool {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	verified, ok := s.verified[storageRelPath]
+	return ok && verified.digest == state.digest && verified.size == state.size &&
+		verified.modTime.Equal(state.modTime)
+}
+
+// modTimeFile is the storage file reporting the original file modification time.
+type modTimeFile struct {
+	http.File
+	modTime time.Time
+}
+
+func (f *modTimeFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &modTimeFileInfo{FileInfo: info, modTime: f.modTime}, nil
+}
+
+type modTimeFileInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (fi *modTimeFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// recordDigests sets the digests of the storage files collected during this run.
+func (s *Storage) recordDigests() error {
+	for _, sf := range s.FilesMap {
+		if sf.Path == "" {
+			continue
+		}
+
+		f, err := os.Open(sf.StoragePath)
+		if err != nil {
+			return err
+		}
+
+		digest, err := s.hashReader(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		s.filesLock.Lock()
+		sf.Digest = digest
+		s.filesLock.Unlock()
+	}
+	return nil
+}
+
+// openIndexFile opens the Storage.IndexFile of the directory.
+// The index file is looked up in the Storage.FilesMap to get its storage
+// name and opened as is if it's missing there.
+func (s *Storage) openIndexFile(dir string) (http.File, error) {
+	indexPath := path.Join("/", dir, s.IndexFile)
+
+	if s.Enabled {
+		if sf, ok := s.findFile(indexPath); ok {
+			indexPath = "/" + sf.StorageRelPath
+		}
+	}
+
+	f, err := s.openFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
+
+// Fingerprint returns the hash sum of the original file content transformed with
+// the transforms, if any, the same as embedded in the storage file name, so the external
+// tools can reproduce the names. It returns os.ErrNotExist for unknown paths
+// and the files loaded from the manifest.
+func (s *Storage) Fingerprint(relPath string) (string, error) {
+	sf, ok := s.findFile(relPath)
+	if !ok || sf.Path == "" {
+		return "", os.ErrNotExist
+	}
+
+	f, err := s.openSource(sf.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s.hashReader(f)
+}
+
+// OpenSource opens the original file by its relative path. Unlike Open, it reads
+// the file from the input directory rather than the storage. It returns os.ErrNotExist
+// for unknown paths and the files loaded from the manifest, since their source paths are unknown.
+func (s *Storage) OpenSource(relPath string) (io.ReadCloser, error) {
+	sf, ok := s.findFile(relPath)
+	if !ok || sf.Path == "" {
+		return nil, os.ErrNotExist
+	}
+
+	return os.Open(sf.Path)
+}
+
+// Handler returns http.Handler serving files from the storage like http.FileServer
+// does and setting the Cache-Control header for the known storage files.
+// Files with the cache policy get its value, other files get the DefaultCacheControl.
+// Nothing is set when the storage is disabled.
+func (s *Storage) Handler() http.Handler {
+	fileServer := http.FileServer(s)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Enabled {
+			storageRelPath := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+			if sf, ok := s.findStorageFile(storageRelPath); ok {
+				immutable := immutableURL(sf, r)
+
+				if s.ImageVariants {
+					if variant, ok := s.negotiateImage(w, r, sf); ok {
+						sf = variant
+						r = withPath(r, "/"+variant.StorageRelPath)
+					}
+				}
+
+				switch {
+				case sf.CacheControl != "":
+					w.Header().Set("Cache-Control", sf.CacheControl)
+				case immutable:
+					w.Header().Set("Cache-Control", DefaultCacheControl)
+				default:
+					w.Header().Set("Cache-Control", RevalidateCacheControl)
+				}
+			}
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// immutableURL reports whether the URL of the requested storage file changes along with
+// its content, so the response may be cached forever. Pinned names don't contain the hash sum,
+// while the files of the Storage.QueryStringMode are versioned with the query string only.
+func immutableURL(sf StaticFile, r *http.Request) bool {
+	if sf.Pinned {
+		return false
+	}
+	return sf.Hash == "" || r.URL.Query().Get("v") == sf.Hash
+}
+
+// negotiateImage returns the most preferred variant of the image file accepted
+// by the client. The Vary header is set if the image has any variants.
+func (s *Storage) negotiateImage(w http.ResponseWriter, r *http.Request, sf StaticFile) (StaticFile, bool) {
+	ext := filepath.Ext(sf.RelPath)
+	if !isImageExt(ext) {
+		return StaticFile{}, false
+	}
+
+	name := strings.TrimSuffix(sf.RelPath, ext)
+	accept := r.Header.Get("Accept")
+	hasVariants := false
+	var best StaticFile
+	found := false
+
+	for _, variantExt := range ImageVariantExtensions {
+		variant, ok := s.findFile(name + variantExt)
+		if !ok {
+			continue
+		}
+		hasVariants = true
+
+		if !found && acceptsType(accept, imageType(variantExt)) {
+			best, found = variant, true
+		}
+	}
+
+	if hasVariants {
+		w.Header().Add("Vary", "Accept")
+	}
+	return best, found
+}
+
+// Resolve returns relative storage file path from the relative original file path.
+// The path may start with a slash, so "css/style.css" and "/css/style.css" are resolved the same.
+// When storage is disabled it returns unchanged value passed in the function.
+// Unknown paths are handled according to the Storage.MissingPolicy.
+// Aliases registered with Alias are resolved to their paths first.
+func (s *Storage) Resolve(relPath string) string {
+	relPath = s.unalias(relPath)
+
+	if !s.Enabled {
+		return relPath
+	} else if sf, ok := s.findFile(relPath); ok {
+		return s.servedPath(&sf)
+	}
+	return s.resolveMissing(relPath)
+}
+
+// servedPath returns the path the file is served by, which is the original
+// relative path with the Storage.CleanURLs and the resolved storage path otherwise.
+func (s *Storage) servedPath(sf *StaticFile) string {
+	if s.CleanURLs {
+		return sf.RelPath
+	}
+	return sf.resolvedPath()
+}
+
+// ResolveURLWith is like Resolve but joins the resolved path with the prefix,
+// e.g. the CDN base URL of the current request tenant, using a single slash.
+// An empty string is returned if the path is resolved to an empty string.
+func (s *Storage) ResolveURLWith(prefix, relPath string) string {
+	resolved := s.Resolve(relPath)
+	if resolved == "" {
+		return ""
+	}
+
+	return joinURL(prefix, resolved)
+}
+
+// URLForStorageRelPath returns the public URL of the storage file with the path
+// relative to the Storage.OutputDir, e.g. the hashed file name captured from
+// the access logs, joined with the Storage.StaticURL using a single slash.
+// The path isn't required to be present in the storage.
+func (s *Storage) URLForStorageRelPath(storageRelPath string) string {
+	return joinURL(s.StaticURL, normalizeSlashes(storageRelPath))
+}
+
+// ResolveRelative is like Resolve but resolves the reference relative to the directory
+// of the file with the original relative path fromRelPath, the way references in
+// the files are resolved, e.g. "../img/pix.png" from "css/style.css" is resolved
+// as "img/pix.png". References starting with a slash are resolved as is.
+func (s *Storage) ResolveRelative(fromRelPath, refRelPath string) string {
+	if strings.HasPrefix(refRelPath, "/") {
+		return s.Resolve(refRelPath)
+	}
+
+	relPath := path.Join(path.Dir(strings.TrimPrefix(fromRelPath, "/")), refRelPath)
+	return s.Resolve(strings.TrimPrefix(relPath, "/"))
+}
+
+// ResolveWithExtFallback is like Resolve but when the path isn't found as is,
+// it tries the path with each of the extensions appended in the given order,
+// e.g. "css/style" is resolved as "css/style.css" with the ".css" extension given.
+// When storage is disabled the extensions are tried against the input directories.
+func (s *Storage) ResolveWithExtFallback(relPath string, exts ...string) string {
+	relPath = s.unalias(relPath)
+	candidates := []string{relPath}
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		candidates = append(candidates, relPath+ext)
+	}
+
+	for _, candidate := range candidates {
+		if !s.Enabled {
+			if s.inputFileExists(candidate) {
+				return candidate
+			}
+		} else if sf, ok := s.findFile(candidate); ok {
+			return s.servedPath(&sf)
+		}
+	}
+
+	if !s.Enabled {
+		return relPath
+	}
+	return s.resolveMissing(relPath)
+}
+
+// inputFileExists reports whether the file with the relative path
+// exists in any of the input directories.
+func (s *Storage) inputFileExists(relPath string) bool {
+	for _, dir := range s.inputDirs {
+		dirRelPath, ok := s.inputRelPath(dir, relPath)
+		if !ok {
+			continue
+		}
+
+		if stat, err := os.Stat(filepath.Join(dir, dirRelPath)); err == nil && !stat.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds the file by its original relative path taking
+// into account the Storage.CaseInsensitive option.
+func (s *Storage) lookup(relPath string) (*StaticFile, bool) {
+	relPath = strings.TrimPrefix(relPath, "/")
+
+	if sf, ok := s.FilesMap[relPath]; ok {
+		return sf, true
+	}
+
+	if s.CaseInsensitive {
+		s.indexLock.Lock()
+		if s.caseIndex == nil {
+			s.buildCaseIndex()
+		}
+		key, ok := s.caseIndex[strings.ToLower(relPath)]
+		s.indexLock.Unlock()
+
+		if ok {
+			sf, ok := s.FilesMap[key]
+			return sf, ok
+		}
+	}
+
+	return nil, false
+}
+
+// findFile is like lookup but is safe for use concurrently with the collection.
+// It returns the copy of the file, so it isn't changed by the following collections.
+func (s *Storage) findFile(relPath string) (StaticFile, bool) {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	if sf, ok := s.lookup(relPath); ok {
+		return *sf, true
+	}
+	return StaticFile{}, false
+}
+
+// findStorageFile is like findFile but finds the file by its storage relative path.
+func (s *Storage) findStorageFile(storageRelPath string) (StaticFile, bool) {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	if sf, ok := s.lookupStorage(storageRelPath); ok {
+		return *sf, true
+	}
+	return StaticFile{}, false
+}
+
+// IsManaged reports whether the storage relative file path belongs
+// to the file collected into the storage, e.g. to decide on caching.
+// The path may start with a slash.
+func (s *Storage) IsManaged(storageRelPath string) bool {
+	_, ok := s.findStorageFile(storageRelPath)
+	return ok
+}
+
+// Referrers returns the sorted original relative paths of the files referencing
+// the file with the original relative path, e.g. the CSS files pointing to an image.
+// References are recorded by the post-processing rules during the collection,
+// so the result is empty for the storage loaded from the manifest only.
+func (s *Storage) Referrers(relPath string) []string {
+	relPath = strings.TrimPrefix(relPath, "/")
+
+	s.referencesLock.Lock()
+	defer s.referencesLock.Unlock()
+
+	var referrers []string
+	for referrer, references := range s.references {
+		for _, reference := range references {
+			if reference == relPath {
+				referrers = append(referrers, referrer)
+				break
+			}
+		}
+	}
+
+	sort.Strings(referrers)
+	return referrers
+}
+
+// setReferences records the original relative paths of the files
+// referenced by the file with the relative path replacing the previous ones.
+func (s *Storage) setReferences(relPath string, references []string) {
+	s.referencesLock.Lock()
+	defer s.referencesLock.Unlock()
+
+	if len(references) == 0 {
+		delete(s.references, relPath)
+		return
+	}
+
+	if s.references == nil {
+		s.references = make(map[string][]string)
+	}
+	s.references[relPath] = references
+}
+
+// lookupStorage finds the file by its storage relative path.
+func (s *Storage) lookupStorage(storageRelPath string) (*StaticFile, bool) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.storageIndex == nil {
+		s.storageIndex = make(map[string]*StaticFile, len(s.FilesMap))
+		for _, sf := range s.FilesMap {
+			s.storageIndex[sf.StorageRelPath] = sf
+		}
+	}
+
+	sf, ok := s.storageIndex[strings.TrimPrefix(storageRelPath, "/")]
+	return sf, ok
+}
+
+// resetIndexes drops lookup structures built from the Storage.FilesMap
+// so they are rebuilt on the next use.
+func (s *Storage) resetIndexes() {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	s.caseIndex = nil
+	s.rewriteRegex = nil
+	s.storageIndex = nil
+	s.verified = nil
+}
+
+// buildCaseIndex maps lowercased Storage.FilesMap keys to the original ones.
+// Keys differing only by case are reported, the first one in sorted order wins.
+func (s *Storage) buildCaseIndex() {
+	keys := make([]string, 0, len(s.FilesMap))
+	for key := range s.FilesMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s.caseIndex = make(map[string]string, len(keys))
+	for _, key := range keys {
+		lowerKey := strings.ToLower(key)
+		if existing, ok := s.caseIndex[lowerKey]; ok {
+			log.Printf("Paths '%s' and '%s' differ only by case, '%s' is used", existing, key, existing)
+			continue
+		}
+		s.caseIndex[lowerKey] = key
+	}
+}
+
+// Hash returns the hex-encoded MD5 sum of the collected content of the file with
+// the original relative path, e.g. to validate caches regardless of the storage
+// file names format. It's recorded in the manifest with the Storage.RecordContentHash,
+// so it survives the reloads. An empty string is returned for the unknown paths,
+// the files collected without the option and the ones loaded from the manifests
+// older than version 4.
+func (s *Storage) Hash(relPath string) string {
+	sf, ok := s.findFile(relPath)
+	if !ok {
+		return ""
+	}
+	return sf.ContentHash
+}
+
+// PreloadLinks returns the Link header values preloading the files with the original
+// relative paths by their resolved URLs, e.g. for the HTTP/2 push or 103 Early Hints:
+//
+// 		</css/style.98718311206c.css>; rel=preload; as=style
+//
+// The "as" attribute is derived from the file extension, fonts are preloaded
+// with the "type" and "crossorigin" attributes as required by browsers.
+// The URLs are joined with the Storage.StaticURL, so the files are served
+// from the site root if it's empty. Paths resolved to an empty string are skipped.
+func (s *Storage) PreloadLinks(relPaths []string) []string {
+	links := make([]string, 0, len(relPaths))
+
+	for _, relPath := range relPaths {
+		resolved := s.Resolve(relPath)
+		if resolved == "" {
+			continue
+		}
+
+		link := "<" + joinURL(s.StaticURL, resolved) + ">; rel=preload"
+		ext := strings.ToLower(path.Ext(relPath))
+
+		switch ext {
+		case ".css":
+			link += "; as=style"
+		case ".js", ".mjs":
+			link += "; as=script"
+		case ".woff", ".woff2", ".ttf", ".otf":
+			link += fmt.Sprintf("; as=font; type=%q; crossorigin", "font/"+ext[1:])
+		case ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".avif", ".ico":
+			link += "; as=image"
+		}
+
+		links = append(links, link)
+	}
+
+	return links
+}
+
+// ContentType returns the MIME type of the file with the original relative path
+// recorded with the Storage.RecordContentType. It returns an empty string
+// for unknown paths and the files without the recorded type.
+func (s *Storage) ContentType(relPath string) string {
+	if sf, ok := s.findFile(relPath); ok {
+		return sf.ContentType
+	}
+	return ""
+}
+
+// ResolveE is like Resolve but returns ErrAssetNotFound for unknown paths
+// instead of applying the Storage.MissingPolicy.
+func (s *Storage) ResolveE(relPath string) (string, error) {
+	relPath = s.unalias(relPath)
+
+	if !s.Enabled {
+		return relPath, nil
+	} else if sf, ok := s.findFile(relPath); ok {
+		return s.servedPath(&sf), nil
+	}
+	return "", ErrAssetNotFound
+}
+
+func (s *Storage) resolveMissing(relPath string) string {
+	if s.OnMissing != nil {
+		s.OnMissing(relPath)
+	}
+
+	switch s.MissingPolicy {
+	case ReturnOriginal:
+		return relPath
+	case Panic:
+		panic(fmt.Sprintf("staticfiles: unable to resolve '%s'", relPath))
+	default:
+		return ""
 	}
-	return ""
 }
@@ -1,14 +1,33 @@
 package staticfiles
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"github.com/stretchr/testify/suite"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type StorageTestSuite struct {
@@ -34,7 +53,7 @@ func (s *StorageTestSuite) SetupSuite() {
 func (s *StorageTestSuite) listDir(dir string) (files []string, err error) {
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if path != dir {
-			files = append(files, strings.TrimPrefix(path, dir))
+			files = append(files, filepath.ToSlash(strings.TrimPrefix(path, dir)))
 		}
 		return nil
 	})
@@ -76,77 +95,243 @@ func (s *StorageTestSuite) TestCollectStatic() {
 	)
 }
 
-func (s *StorageTestSuite) TestIgnorePatterns() {
-	inputDir := filepath.Join(s.InputRootDir, "base")
-	outputDir := filepath.Join(s.OutputRootDir, "ignore")
-	expectedDir := filepath.Join(s.ExpectedRootDir, "ignore")
+// memoryBackend is the OutputBackend capturing the written files.
+type memoryBackend struct {
+	files       map[string]string
+	shortWrites bool
+}
+
+func (b *memoryBackend) Write(path string, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// Short writes drop the last byte of the content
+	if b.shortWrites && len(data) > 0 {
+		data = data[:len(data)-1]
+	}
+
+	b.files[filepath.ToSlash(path)] = string(data)
+	return int64(len(data)), nil
+}
+
+func (b *memoryBackend) Exists(path string) (bool, error) {
+	_, ok := b.files[filepath.ToSlash(path)]
+	return ok, nil
+}
+
+func (b *memoryBackend) Delete(path string) error {
+	delete(b.files, filepath.ToSlash(path))
+	return nil
+}
+
+func (s *StorageTestSuite) TestOutputBackend() {
+	inputDir := filepath.Join(s.OutputRootDir, "backend/input")
+	outputDir := filepath.Join(s.OutputRootDir, "backend/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "app.js"), []byte("abc"), 0644)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "sw.js"), []byte("self"), 0644)
+	s.Require().NoError(err)
+
+	backend := &memoryBackend{files: make(map[string]string)}
 
 	storage, err := NewStorage(outputDir)
 	s.Require().NoError(err)
 	storage.AddInputDir(inputDir)
-	storage.AddIgnorePattern("css/import.css")
-	storage.AddIgnorePattern("**/*.png")
+	storage.Pin("sw.js", "sw.js")
+	storage.OutputBackend = backend
 
 	err = storage.CollectStatic()
 	s.Require().NoError(err)
 
-	files1, err := s.listDir(expectedDir)
+	prefix := filepath.ToSlash(outputDir) + "/"
+	s.Equal("abc", backend.files[prefix+"app.900150983cd2.js"])
+	s.Equal("self", backend.files[prefix+"sw.js"])
+	s.Contains(backend.files[prefix+ManifestFilename], `"app.js":"app.900150983cd2.js"`)
+
+	// Output directory isn't even created
+	_, err = os.Stat(outputDir)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *StorageTestSuite) TestOutputBackend_UnsupportedOptions() {
+	outputDir := filepath.Join(s.OutputRootDir, "backend_options")
+
+	options := map[string]func(storage *Storage){
+		"Gzip":                   func(storage *Storage) { storage.Gzip = true },
+		"Brotli":                 func(storage *Storage) { storage.Brotli = CommandEncoder("brotli") },
+		"VerifyOnOpen":           func(storage *Storage) { storage.VerifyOnOpen = true },
+		"EmitLatestAlias":        func(storage *Storage) { storage.EmitLatestAlias = true },
+		"FailOnBrokenReferences": func(storage *Storage) { storage.FailOnBrokenReferences = true },
+		"AddOutputMirror":        func(storage *Storage) { storage.AddOutputMirror(outputDir + "_mirror") },
+		"PreserveEmptyDirs":      func(storage *Storage) { storage.PreserveEmptyDirs = true },
+	}
+	for option, enable := range options {
+		storage, err := NewStorage(outputDir)
+		s.Require().NoError(err)
+		storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+		storage.OutputBackend = &memoryBackend{files: make(map[string]string)}
+		enable(storage)
+
+		err = storage.CollectStatic()
+		s.Equal(&UnsupportedOptionError{Option: option}, err)
+
+		err = storage.CollectFiles([]string{"css/style.css"})
+		s.Equal(&UnsupportedOptionError{Option: option}, err)
+	}
+}
+
+func (s *StorageTestSuite) TestOutputBackend_PostProcess() {
+	inputDir := filepath.Join(s.OutputRootDir, "backend_css/input")
+	outputDir := filepath.Join(s.OutputRootDir, "backend_css/output")
+
+	err := os.MkdirAll(filepath.Join(inputDir, "img"), 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "img/pix.png"), []byte("png"), 0644)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "style.css"), []byte(`div { background: url("img/pix.png") }`), 0644)
 	s.Require().NoError(err)
 
-	files2, err := s.listDir(outputDir)
+	for _, hashDependencies := range []bool{false, true} {
+		backend := &memoryBackend{files: make(map[string]string)}
+
+		storage, err := NewStorage(outputDir)
+		s.Require().NoError(err)
+		storage.AddInputDir(inputDir)
+		storage.OutputBackend = backend
+		storage.HashDependencies = hashDependencies
+
+		err = storage.CollectStatic()
+		s.Require().NoError(err)
+
+		prefix := filepath.ToSlash(outputDir) + "/"
+		s.Equal(`div { background: url("img/pix.bff139fa05ac.png") }`, backend.files[prefix+storage.Resolve("style.css")])
+
+		// Storage files renamed by the rule are removed from the backend
+		var styleFiles []string
+		for path := range backend.files {
+			if strings.HasPrefix(path, prefix+"style.") {
+				styleFiles = append(styleFiles, strings.TrimPrefix(path, prefix))
+			}
+		}
+		s.Equal([]string{storage.Resolve("style.css")}, styleFiles)
+	}
+}
+
+func (s *StorageTestSuite) TestOutputBackend_ShortWrite() {
+	inputDir := filepath.Join(s.OutputRootDir, "backend_short/input")
+	outputDir := filepath.Join(s.OutputRootDir, "backend_short/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "app.js"), []byte("abc"), 0644)
 	s.Require().NoError(err)
 
-	s.True(
-		reflect.DeepEqual(files1, files2),
-		"The list of files in `%s` and `%s` differs from each other", expectedDir, outputDir,
-	)
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.OutputBackend = &memoryBackend{files: make(map[string]string), shortWrites: true}
+
+	err = storage.CollectStatic()
+	s.Equal(ErrCopySizeMismatch, err)
+
+	// Pinned files are copied directly
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Pin("app.js", "app.js")
+	storage.OutputBackend = &memoryBackend{files: make(map[string]string), shortWrites: true}
+
+	err = storage.CollectStatic()
+	s.Equal(ErrCopySizeMismatch, err)
 }
 
-func (s *StorageTestSuite) TestPostProcess() {
-	suffix := "base"
-	inputDir := filepath.Join(s.InputRootDir, suffix)
-	outputDir := filepath.Join(s.OutputRootDir, suffix)
-	expectedDir := filepath.Join(s.ExpectedRootDir, suffix)
+func (s *StorageTestSuite) TestCollectStatic_OutputMirror() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "mirror/primary")
+	mirrorDir := filepath.Join(s.OutputRootDir, "mirror/secondary")
 
 	storage, err := NewStorage(outputDir)
 	s.Require().NoError(err)
 	storage.AddInputDir(inputDir)
+	storage.AddOutputMirror(mirrorDir)
 
 	err = storage.CollectStatic()
 	s.Require().NoError(err)
 
-	files1, err := s.listDir(expectedDir)
+	files1, err := s.listDir(outputDir)
 	s.Require().NoError(err)
 
+	files2, err := s.listDir(mirrorDir)
+	s.Require().NoError(err)
+
+	s.Require().True(
+		reflect.DeepEqual(files1, files2),
+		"The list of files in `%s` and `%s` differs from each other", outputDir, mirrorDir,
+	)
+
 	for _, relPath := range files1 {
-		stat, err := os.Stat(filepath.Join(expectedDir, relPath))
+		outPath := filepath.Join(outputDir, relPath)
+		mirrorPath := filepath.Join(mirrorDir, relPath)
+
+		stat, err := os.Stat(outPath)
 		s.Require().NoError(err)
 		if stat.IsDir() {
 			continue
 		}
 
-		expPath := filepath.Join(expectedDir, relPath)
-		outPath := filepath.Join(outputDir, relPath)
-
 		s.Require().True(
-			s.compareFiles(expPath, outPath),
-			"The files content of `%s` and `%s` differs from each other", expPath, outPath,
+			s.compareFiles(outPath, mirrorPath),
+			"The files content of `%s` and `%s` differs from each other", outPath, mirrorPath,
 		)
 	}
 }
 
-func (s *StorageTestSuite) TestPostProcess_UpdateFile() {
-	suffix := "update"
-	inputDir := filepath.Join(s.InputRootDir, suffix)
-	outputDir := filepath.Join(s.OutputRootDir, suffix)
+func (s *StorageTestSuite) TestClose() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "close"))
+	s.Require().NoError(err)
 
-	// Truncate image file
-	imgPath := filepath.Join(inputDir, "pix.png")
-	f, err := os.OpenFile(imgPath, os.O_RDWR|os.O_TRUNC, 0644)
+	s.NoError(storage.Close())
+	s.NoError(storage.Close())
+
+	// Storage with a running watcher-like goroutine
+	storage, err = NewStorage(filepath.Join(s.OutputRootDir, "close"))
 	s.Require().NoError(err)
-	f.Close()
 
-	// Collect files as usual
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		<-stop
+		close(stopped)
+	}()
+
+	var calls []string
+	storage.addCloser(func() error {
+		calls = append(calls, "watcher")
+		close(stop)
+		<-stopped
+		return nil
+	})
+	storage.addCloser(func() error {
+		calls = append(calls, "last")
+		return io.ErrClosedPipe
+	})
+
+	s.Equal(io.ErrClosedPipe, storage.Close())
+	s.Equal([]string{"last", "watcher"}, calls)
+
+	s.NoError(storage.Close())
+	s.Equal([]string{"last", "watcher"}, calls)
+}
+
+func (s *StorageTestSuite) TestStats() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "stats")
+
 	storage, err := NewStorage(outputDir)
 	s.Require().NoError(err)
 	storage.AddInputDir(inputDir)
@@ -154,109 +339,3472 @@ func (s *StorageTestSuite) TestPostProcess_UpdateFile() {
 	err = storage.CollectStatic()
 	s.Require().NoError(err)
 
-	// Compare content of the css file with expected one
-	s.Require().True(s.compareFiles(
-		filepath.Join(outputDir, storage.Resolve("style.css")),
-		filepath.Join(s.ExpectedRootDir, suffix+"/style.before.css")),
-	)
+	var expectedCount int
+	var expectedBytes int64
+	err = filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() != ManifestFilename {
+			expectedCount++
+			expectedBytes += info.Size()
+		}
+		return err
+	})
+	s.Require().NoError(err)
 
-	// Change content of the image referenced in css file
-	err = ioutil.WriteFile(imgPath, []byte("abc"), 0644)
+	fileCount, totalBytes := storage.Stats()
+	s.Equal(expectedCount, fileCount)
+	s.Equal(expectedBytes, totalBytes)
+}
+
+func (s *StorageTestSuite) TestCSPHash() {
+	inputDir := filepath.Join(s.OutputRootDir, "csp_hash/input")
+	outputDir := filepath.Join(s.OutputRootDir, "csp_hash/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "app.js"), []byte("alert('Hello');"), 0644)
 	s.Require().NoError(err)
 
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
 	err = storage.CollectStatic()
 	s.Require().NoError(err)
 
-	// Image reference is expected to change
-	s.Require().True(s.compareFiles(
-		filepath.Join(outputDir, storage.Resolve("style.css")),
-		filepath.Join(s.ExpectedRootDir, suffix+"/style.after.css")),
+	expected := "sha256-gKHd+pSZOJ3MwBsFalomyNobAcinjJ44ArqbIKlcniQ="
+	s.Equal(expected, storage.CSPHash("app.js"))
+	s.Equal("", storage.CSPHash("file-not-exist.js"))
+
+	storage.Enabled = false
+	s.Equal(expected, storage.CSPHash("app.js"))
+}
+
+func (s *StorageTestSuite) TestWriteReport() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	var buf bytes.Buffer
+	err = storage.WriteReport(&buf)
+	s.Require().NoError(err)
+
+	s.Equal(
+		"ORIGINAL           STORAGE                         SIZE\n"+
+			"css/import.css     css/import.5f15d96d5cdb.css     61\n"+
+			"css/style.css      css/style.98718311206c.css      362\n"+
+			"css/style.css.map  css/style.css.8a80554c91d9.map  3\n"+
+			"img/pix.png        img/pix.3eaf17869bb5.png        67\n",
+		buf.String(),
 	)
+
+	buf.Reset()
+	storage.ReportSRI = true
+	err = storage.WriteReport(&buf)
+	s.Require().NoError(err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	s.Len(lines, 5)
+	s.True(strings.HasSuffix(lines[0], "SRI"))
+	s.Contains(lines[4], "img/pix.3eaf17869bb5.png")
+	s.Regexp(`sha384-[A-Za-z0-9+/]{64}$`, lines[4])
 }
 
-func (s *StorageTestSuite) TestPostProcess_BrokenURL() {
-	suffix := "broken_url"
-	inputDir := filepath.Join(s.InputRootDir, suffix)
-	outputDir := filepath.Join(s.OutputRootDir, suffix)
+func (s *StorageTestSuite) TestIgnorePatterns() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "ignore")
+	expectedDir := filepath.Join(s.ExpectedRootDir, "ignore")
 
-	// Collect files as usual
 	storage, err := NewStorage(outputDir)
 	s.Require().NoError(err)
 	storage.AddInputDir(inputDir)
+	storage.AddIgnorePattern("css/import.css")
+	storage.AddIgnorePattern("**/*.png")
 
 	err = storage.CollectStatic()
 	s.Require().NoError(err)
 
-	s.Require().True(s.compareFiles(
-		filepath.Join(outputDir, storage.Resolve("style.css")),
-		filepath.Join(inputDir, "style.css")),
+	files1, err := s.listDir(expectedDir)
+	s.Require().NoError(err)
+
+	files2, err := s.listDir(outputDir)
+	s.Require().NoError(err)
+
+	s.True(
+		reflect.DeepEqual(files1, files2),
+		"The list of files in `%s` and `%s` differs from each other", expectedDir, outputDir,
 	)
 }
 
-func (s *StorageTestSuite) TestResolve_CollectStatic() {
-	storage, err := NewStorage("testdata/output/base")
+func (s *StorageTestSuite) TestCollectFiles() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "collect_files")
+
+	storage, err := NewStorage(outputDir)
 	s.Require().NoError(err)
-	storage.AddInputDir("testdata/input/base")
+	storage.AddInputDir(inputDir)
 
-	err = storage.CollectStatic()
+	var processed []string
+	storage.RegisterRule(func(storage *Storage, file *StaticFile) error {
+		processed = append(processed, file.RelPath)
+		return nil
+	})
+
+	err = storage.CollectFiles([]string{
+		filepath.Join(inputDir, "img/pix.png"),
+		"./" + filepath.Join(inputDir, "css/style.css.map"),
+	})
 	s.Require().NoError(err)
 
-	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
-	s.Equal("", storage.Resolve("file-not-exist"))
-}
+	sort.Strings(processed)
+	s.Equal([]string{"css/style.css.map", "img/pix.png"}, processed)
 
-func (s *StorageTestSuite) TestResolve_LoadManifest() {
-	storage, err := NewStorage("testdata/expected/base")
+	files, err := s.listDir(outputDir)
 	s.Require().NoError(err)
+	s.Equal([]string{"/css", "/css/style.css.8a80554c91d9.map", "/img", "/img/pix.3eaf17869bb5.png", "/" + ManifestFilename}, files)
 
-	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
-	s.Equal("", storage.Resolve("file-not-exist"))
-}
+	// Files are merged into the existing manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
 
-func (s *StorageTestSuite) TestResolve_StorageDisabled() {
-	storage, err := NewStorage("testdata/expected/base")
+	err = storage.CollectFiles([]string{filepath.Join(inputDir, "css/import.css")})
 	s.Require().NoError(err)
-	storage.Enabled = false
 
-	s.Equal("css/style.css", storage.Resolve("css/style.css"))
-	s.Equal("null", storage.Resolve("null"))
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Len(storage.FilesMap, 3)
+	s.Equal("css/import.5f15d96d5cdb.css", storage.Resolve("css/import.css"))
+	s.Equal("img/pix.3eaf17869bb5.png", storage.Resolve("img/pix.png"))
+
+	storage.AddInputDir(inputDir)
+	err = storage.CollectFiles([]string{filepath.Join(s.InputRootDir, "broken_url/style.css")})
+	s.Equal(ErrOutsideInputDirs, err)
 }
 
-func (s *StorageTestSuite) TestOpen_File() {
-	storage, err := NewStorage("testdata/input/base")
+func (s *StorageTestSuite) TestIgnoreFile() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "ignore_file"))
 	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "ignore_file"))
 
-	f, err := storage.Open("css/style.css")
-	s.Assert().NoError(err)
-	s.Assert().NotNil(f)
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Patterns without a slash match the names at any depth
+	var relPaths []string
+	for relPath := range storage.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+	s.Equal([]string{"css/style.css", "css/vendor.css"}, relPaths)
+
+	err = storage.CollectFiles([]string{
+		filepath.Join(s.InputRootDir, "ignore_file/css/drafts/wip.css"),
+		filepath.Join(s.InputRootDir, "ignore_file/css/old.css.bak"),
+		filepath.Join(s.InputRootDir, "ignore_file/vendor.css"),
+	})
+	s.Require().NoError(err)
+	s.Len(storage.FilesMap, 2)
+
+	// Patterns are scoped to the input directory containing the file
+	storage, err = NewStorage(filepath.Join(s.OutputRootDir, "ignore_file_scope"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "ignore_file/drafts"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Contains(storage.FilesMap, "wip.css")
 }
 
-func (s *StorageTestSuite) TestOpen_File_StorageDisabled() {
-	storage, err := NewStorage("testdata/input/storage_disabled/output")
+func (s *StorageTestSuite) TestCollectStatic_SkipManifest() {
+	inputDir := filepath.Join(s.OutputRootDir, "skip_manifest/input")
+	outputDir := filepath.Join(s.OutputRootDir, "skip_manifest/output")
+
+	// Input directory containing the previous output
+	err := os.MkdirAll(filepath.Join(inputDir, "old"), 0755)
 	s.Require().NoError(err)
-	storage.AddInputDir("testdata/input/storage_disabled/input")
 
-	storage.Enabled = false
-	f, err := storage.Open("file.css")
-	s.Assert().NoError(err)
-	s.Assert().NotNil(f)
+	files := []string{"style.css", "old/" + ManifestFilename, "old/" + ManifestGzipFilename, "old/" + ManifestChecksumFilename}
+	for _, name := range files {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte("{}"), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	var relPaths []string
+	for relPath := range storage.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	s.Equal([]string{"style.css"}, relPaths)
 }
 
-func (s *StorageTestSuite) TestOpen_Dir_ListEnabled() {
-	storage, err := NewStorage("testdata/input/base")
+func (s *StorageTestSuite) TestAddIgnoreDir() {
+	rootDir := filepath.Join(s.OutputRootDir, "ignore_dir")
+	err := os.MkdirAll(filepath.Join(rootDir, "assets"), 0755)
 	s.Require().NoError(err)
 
-	f, err := storage.Open("css")
-	s.Assert().NoError(err)
-	s.Assert().NotNil(f)
+	err = ioutil.WriteFile(filepath.Join(rootDir, "assets/app.css"), []byte("a {}"), 0644)
+	s.Require().NoError(err)
+
+	// Output of the first storage is placed in the input directory of the second one
+	storage1, err := NewStorage(filepath.Join(rootDir, "assets_out"))
+	s.Require().NoError(err)
+	storage1.AddInputDir(filepath.Join(rootDir, "assets"))
+
+	err = storage1.CollectStatic()
+	s.Require().NoError(err)
+
+	storage2, err := NewStorage(filepath.Join(s.OutputRootDir, "ignore_dir_out"))
+	s.Require().NoError(err)
+	storage2.AddInputDir(rootDir)
+	storage2.AddIgnoreDir(storage1.OutputDir)
+
+	err = storage2.CollectStatic()
+	s.Require().NoError(err)
+
+	var relPaths []string
+	for relPath := range storage2.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	s.Equal([]string{"assets/app.css"}, relPaths)
 }
 
-func (s *StorageTestSuite) TestOpen_Dir_ListDisabled() {
-	storage, err := NewStorage("testdata/input/base")
+func (s *StorageTestSuite) TestIgnoreHidden() {
+	suffix := "hidden"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, suffix+"/disabled"))
 	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
 
-	storage.OutputDirList = false
-	f, err := storage.Open("css")
-	s.Assert().True(os.IsNotExist(err))
-	s.Assert().Nil(f)
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Contains(storage.FilesMap, ".DS_Store")
+
+	storage, err = NewStorage(filepath.Join(s.OutputRootDir, suffix+"/enabled"))
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.IgnoreHidden = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	var relPaths []string
+	for relPath := range storage.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	s.Equal([]string{"css/style.css"}, relPaths)
+}
+
+func (s *StorageTestSuite) TestMaxFileSize() {
+	inputDir := filepath.Join(s.OutputRootDir, "max_file_size/input")
+	outputDir := filepath.Join(s.OutputRootDir, "max_file_size/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	err = ioutil.WriteFile(filepath.Join(inputDir, "small.txt"), bytes.Repeat([]byte("a"), 10), 0644)
+	s.Require().NoError(err)
+
+	err = ioutil.WriteFile(filepath.Join(inputDir, "video.mp4"), bytes.Repeat([]byte("a"), 11), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.MaxFileSize = 10
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Contains(storage.FilesMap, "small.txt")
+	s.NotContains(storage.FilesMap, "video.mp4")
+
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, ManifestFilename))
+	s.Require().NoError(err)
+	s.NotContains(string(data), "video.mp4")
+}
+
+func (s *StorageTestSuite) TestPreserveEmptyDirs() {
+	inputDir := filepath.Join(s.OutputRootDir, "empty_dirs/input")
+	outputDir := filepath.Join(s.OutputRootDir, "empty_dirs/output")
+
+	for _, dir := range []string{"uploads/tmp", ".git/objects/ab", "drafts", "cache"} {
+		err := os.MkdirAll(filepath.Join(inputDir, dir), 0755)
+		s.Require().NoError(err)
+	}
+	err := ioutil.WriteFile(filepath.Join(inputDir, "style.css"), []byte("div {}"), 0644)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "drafts/wip.css"), []byte("p {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.AddIgnorePattern("drafts/*")
+	storage.AddIgnorePattern("cache")
+	storage.IgnoreHidden = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	_, err = os.Stat(filepath.Join(outputDir, "uploads"))
+	s.True(os.IsNotExist(err))
+
+	storage.PreserveEmptyDirs = true
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.DirExists(filepath.Join(outputDir, "uploads/tmp"))
+
+	// Ignored, hidden and not empty directories aren't created
+	for _, dir := range []string{".git", "drafts", "cache"} {
+		_, err = os.Stat(filepath.Join(outputDir, dir))
+		s.True(os.IsNotExist(err), dir)
+	}
+
+	// Directories are created with the backend
+	storage, err = NewStorage(filepath.Join(s.OutputRootDir, "empty_dirs/backend"))
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.OutputBackend = &memoryBackend{files: make(map[string]string)}
+	storage.PreserveEmptyDirs = true
+
+	err = storage.CollectStatic()
+	s.Equal(&UnsupportedOptionError{Option: "PreserveEmptyDirs"}, err)
+}
+
+func (s *StorageTestSuite) TestOnFileCollected() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "on_file_collected"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	var collected []string
+	storage.OnFileCollected = func(sf *StaticFile) error {
+		_, err := os.Stat(sf.StoragePath)
+		s.NoError(err)
+		collected = append(collected, sf.RelPath+" "+sf.StorageRelPath)
+		return nil
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal([]string{
+		"css/import.css css/import.5f15d96d5cdb.css",
+		"css/style.css css/style.98718311206c.css",
+		"css/style.css.map css/style.css.8a80554c91d9.map",
+		"img/pix.png img/pix.3eaf17869bb5.png",
+	}, collected)
+
+	// Errors abort the collection
+	callbackErr := errors.New("upload failed")
+	storage.OnFileCollected = func(sf *StaticFile) error {
+		return callbackErr
+	}
+	err = storage.CollectStatic()
+	s.Equal(callbackErr, err)
+}
+
+func (s *StorageTestSuite) TestCollectOnce() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "collect_once"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	collected := 0
+	storage.OnFileCollected = func(sf *StaticFile) error {
+		collected++
+		return nil
+	}
+
+	err = storage.CollectOnce()
+	s.Require().NoError(err)
+	s.Equal(4, collected)
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+
+	err = storage.CollectOnce()
+	s.Require().NoError(err)
+	s.Equal(4, collected)
+
+	err = storage.ForceCollect()
+	s.Require().NoError(err)
+	s.Equal(8, collected)
+
+	err = storage.CollectOnce()
+	s.Require().NoError(err)
+	s.Equal(8, collected)
+
+	// Errors of the forced collections are returned by the subsequent calls
+	collectErr := errors.New("boom")
+	storage.OnFileCollected = func(sf *StaticFile) error {
+		return collectErr
+	}
+	s.Equal(collectErr, storage.ForceCollect())
+	s.Equal(collectErr, storage.CollectOnce())
+}
+
+func (s *StorageTestSuite) TestCollectOnce_Error() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "collect_once_error"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	collectErr := errors.New("boom")
+	storage.OnFileCollected = func(sf *StaticFile) error {
+		return collectErr
+	}
+	s.Equal(collectErr, storage.CollectOnce())
+	s.Equal(collectErr, storage.CollectOnce())
+
+	storage.OnFileCollected = nil
+	s.NoError(storage.ForceCollect())
+	s.NoError(storage.CollectOnce())
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+}
+
+func (s *StorageTestSuite) TestRecordContentHash() {
+	outputDir := filepath.Join(s.OutputRootDir, "content_hash")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.RecordContentHash = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("98718311206ce188bf7260e1d0bbbcea", storage.Hash("css/style.css"))
+	s.Equal("3eaf17869bb51bf27bd7c91bc9853973", storage.Hash("img/pix.png"))
+	s.Equal("", storage.Hash("file-not-exist"))
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Equal("98718311206ce188bf7260e1d0bbbcea", storage.Hash("css/style.css"))
+	s.Equal("3eaf17869bb51bf27bd7c91bc9853973", storage.Hash("img/pix.png"))
+}
+
+func (s *StorageTestSuite) TestTempDir() {
+	outputDir := filepath.Join(s.OutputRootDir, "temp_dir")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	storage.TempDir = filepath.Join(outputDir, "dir-not-exist")
+	err = storage.CollectStatic()
+	s.True(os.IsNotExist(err))
+
+	storage.TempDir = outputDir
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+
+	// Staged files are renamed
+	matches, err := filepath.Glob(filepath.Join(outputDir, ".staticfiles-*"))
+	s.Require().NoError(err)
+	s.Empty(matches)
+}
+
+func (s *StorageTestSuite) TestEmitLatestAlias() {
+	inputDir := filepath.Join(s.OutputRootDir, "latest_alias/input")
+	outputDir := filepath.Join(s.OutputRootDir, "latest_alias/output")
+	stylePath := filepath.Join(inputDir, "css/style.css")
+	latestPath := filepath.Join(outputDir, LatestDir, "css/style.css")
+
+	err := os.MkdirAll(filepath.Dir(stylePath), 0755)
+	s.Require().NoError(err)
+
+	for _, content := range []string{"div {}", "p {}"} {
+		err = ioutil.WriteFile(stylePath, []byte(content), 0644)
+		s.Require().NoError(err)
+
+		storage, err := NewStorage(outputDir)
+		s.Require().NoError(err)
+		storage.AddInputDir(inputDir)
+		storage.EmitLatestAlias = true
+
+		err = storage.CollectStatic()
+		s.Require().NoError(err)
+
+		latest, err := ioutil.ReadFile(latestPath)
+		s.Require().NoError(err)
+		s.Equal(content, string(latest))
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	err = storage.LoadManifest()
+	s.Require().NoError(err)
+
+	sf := storage.FilesMap["css/style.css"]
+	s.Require().NotNil(sf)
+	s.Equal("css/style.c3ee3d7a4380.css", sf.StorageRelPath)
+	s.Equal("latest/css/style.css", sf.LatestRelPath)
+	s.NoError(storage.Verify())
+
+	err = os.Remove(latestPath)
+	s.Require().NoError(err)
+	s.Equal(&MissingFilesError{StorageRelPaths: []string{"latest/css/style.css"}}, storage.Verify())
+}
+
+func (s *StorageTestSuite) TestFailOnBrokenReferences() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "broken_references/base"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.FailOnBrokenReferences = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	inputDir := filepath.Join(s.OutputRootDir, "broken_references/input")
+	err = os.MkdirAll(filepath.Join(inputDir, "img"), 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "img/pix.png"), []byte("png"), 0644)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "style.css"), []byte(`div { background: url("img/pxi.png") }`), 0644)
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(filepath.Join(s.OutputRootDir, "broken_references/output"))
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storage.FailOnBrokenReferences = true
+	err = storage.CollectStatic()
+	s.Require().Error(err)
+	refErr, ok := err.(*BrokenReferenceError)
+	s.Require().True(ok, "Unexpected error type %T", err)
+	s.Equal("style.css", refErr.RelPath)
+	s.Equal("img/pxi.png", refErr.URL)
+}
+
+func (s *StorageTestSuite) TestUseHardLinks() {
+	inputDir := filepath.Join(s.OutputRootDir, "hard_links/input")
+	outputDir := filepath.Join(s.OutputRootDir, "hard_links/output")
+	pixPath := filepath.Join(inputDir, "img/pix.png")
+	stylePath := filepath.Join(inputDir, "style.css")
+	style := `div { background: url("img/pix.png") }`
+
+	err := os.MkdirAll(filepath.Dir(pixPath), 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(pixPath, []byte("png"), 0644)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(stylePath, []byte(style), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.UseHardLinks = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	pixStat, err := os.Stat(pixPath)
+	s.Require().NoError(err)
+	storageStat, err := os.Stat(filepath.Join(outputDir, "img/pix.bff139fa05ac.png"))
+	s.Require().NoError(err)
+	s.True(os.SameFile(pixStat, storageStat))
+
+	// Post-processed files are rewritten without changing the source files
+	styleStorageRelPath := storage.Resolve("style.css")
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, styleStorageRelPath))
+	s.Require().NoError(err)
+	s.Equal(`div { background: url("img/pix.bff139fa05ac.png") }`, string(content))
+
+	content, err = ioutil.ReadFile(stylePath)
+	s.Require().NoError(err)
+	s.Equal(style, string(content))
+
+	// Files linked by the previous collection are kept when copied
+	storage.UseHardLinks = false
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	content, err = ioutil.ReadFile(pixPath)
+	s.Require().NoError(err)
+	s.Equal("png", string(content))
+	content, err = ioutil.ReadFile(stylePath)
+	s.Require().NoError(err)
+	s.Equal(style, string(content))
+}
+
+func (s *StorageTestSuite) TestMaxDepth() {
+	inputDir := filepath.Join(s.OutputRootDir, "max_depth/input")
+	outputDir := filepath.Join(s.OutputRootDir, "max_depth/output")
+	deepDir := filepath.Join(inputDir, "a/b/c/d")
+
+	err := os.MkdirAll(deepDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(deepDir, "style.css"), []byte("div {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.MaxDepth = 3
+
+	err = storage.CollectStatic()
+	s.Require().Error(err)
+	depthErr, ok := err.(*MaxDepthError)
+	s.Require().True(ok, "Unexpected error type %T", err)
+	s.Equal(deepDir, depthErr.Path)
+	s.Equal(3, depthErr.MaxDepth)
+
+	err = storage.CollectFiles([]string{filepath.Join(deepDir, "style.css")})
+	s.IsType(&MaxDepthError{}, err)
+
+	storage.MaxDepth = 4
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("a/b/c/d/style.101d4824b7cc.css", storage.Resolve("a/b/c/d/style.css"))
+}
+
+func (s *StorageTestSuite) TestWriteChangeLog() {
+	inputDir := filepath.Join(s.OutputRootDir, "change_log/input")
+	outputDir := filepath.Join(s.OutputRootDir, "change_log/output")
+	stylePath := filepath.Join(inputDir, "style.css")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(stylePath, []byte("div {}"), 0644)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(filepath.Join(inputDir, "pix.png"), []byte("png"), 0644)
+	s.Require().NoError(err)
+
+	var storage *Storage
+	collect := func() string {
+		storage, err = NewStorage(outputDir)
+		s.Require().NoError(err)
+		storage.AddInputDir(inputDir)
+		storage.WriteChangeLog = true
+
+		err = storage.CollectStatic()
+		s.Require().NoError(err)
+
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, ChangeLogFilename))
+		s.Require().NoError(err)
+		return string(data)
+	}
+
+	s.Equal(`{"added":["pix.png","style.css"],"changed":[],"removed":[]}`, collect())
+
+	err = ioutil.WriteFile(stylePath, []byte("p {}"), 0644)
+	s.Require().NoError(err)
+	s.Equal(`{"added":[],"changed":["style.css"],"removed":[]}`, collect())
+	s.Equal(`{"added":[],"changed":[],"removed":[]}`, collect())
+
+	err = os.Remove(filepath.Join(inputDir, "pix.png"))
+	s.Require().NoError(err)
+	s.Equal(`{"added":[],"changed":[],"removed":["pix.png"]}`, collect())
+	s.Equal("", storage.Resolve("pix.png"))
+	s.NotContains(storage.FilesMap, "pix.png")
+}
+
+func (s *StorageTestSuite) TestRemoveStale() {
+	inputDir := filepath.Join(s.OutputRootDir, "remove_stale/input")
+	outputDir := filepath.Join(s.OutputRootDir, "remove_stale/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	stylePath := filepath.Join(inputDir, "style.css")
+	err = ioutil.WriteFile(stylePath, []byte("div {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Gzip = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	oldPath := filepath.Join(outputDir, storage.Resolve("style.css"))
+
+	err = ioutil.WriteFile(stylePath, []byte("p {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Gzip = true
+	storage.RemoveStale = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.FileExists(filepath.Join(outputDir, storage.Resolve("style.css")))
+	for _, path := range []string{oldPath, oldPath + GzipExt} {
+		_, err = os.Stat(path)
+		s.True(os.IsNotExist(err), path)
+	}
+}
+
+func (s *StorageTestSuite) TestRemoveStale_OutsideOutputDir() {
+	rootDir := filepath.Join(s.OutputRootDir, "remove_stale_outside")
+	inputDir := filepath.Join(rootDir, "input")
+	outputDir := filepath.Join(rootDir, "output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = os.MkdirAll(outputDir, 0755)
+	s.Require().NoError(err)
+
+	err = ioutil.WriteFile(filepath.Join(inputDir, "style.css"), []byte("div {}"), 0644)
+	s.Require().NoError(err)
+
+	victimPath := filepath.Join(rootDir, "victim.css")
+	err = ioutil.WriteFile(victimPath, []byte("keep me"), 0644)
+	s.Require().NoError(err)
+
+	manifests := []string{
+		`{"paths":{"style.css":"../victim.css"},"version":3}`,
+		`{"paths":{"style.css":"css/../../victim.css"},"version":3}`,
+	}
+
+	// Symlinked directory pointing outside of the output directory
+	absRootDir, err := filepath.Abs(rootDir)
+	s.Require().NoError(err)
+	if err = os.Symlink(absRootDir, filepath.Join(outputDir, "link")); err == nil {
+		manifests = append(manifests, `{"paths":{"style.css":"link/victim.css"},"version":3}`)
+	}
+
+	for _, manifest := range manifests {
+		err = ioutil.WriteFile(filepath.Join(outputDir, ManifestFilename), []byte(manifest), 0644)
+		s.Require().NoError(err)
+
+		storage, err := NewStorage(outputDir)
+		s.Require().NoError(err)
+		storage.AddInputDir(inputDir)
+		storage.RemoveStale = true
+
+		err = storage.CollectStatic()
+		s.Equal(ErrOutsideOutputDir, err, manifest)
+		s.FileExists(victimPath, manifest)
+	}
+}
+
+func (s *StorageTestSuite) TestCollectStatic_Symlinks() {
+	inputDir := filepath.Join(s.OutputRootDir, "symlinks/input")
+	outputDir := filepath.Join(s.OutputRootDir, "symlinks/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	targetPath, err := filepath.Abs("testdata/input/base/css/style.css")
+	s.Require().NoError(err)
+
+	for _, name := range []string{"first.css", "second.css"} {
+		err = os.Symlink(targetPath, filepath.Join(inputDir, name))
+		if err != nil {
+			s.T().Skipf("symlinks are not supported: %v", err)
+		}
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal("first.98718311206c.css", storage.FilesMap["first.css"].StorageRelPath)
+	s.Equal("second.98718311206c.css", storage.FilesMap["second.css"].StorageRelPath)
+
+	// Storage files are regular files with the target content
+	info, err := os.Lstat(storage.FilesMap["first.css"].StoragePath)
+	s.Require().NoError(err)
+	s.True(info.Mode().IsRegular())
+	s.True(s.compareFiles(targetPath, storage.FilesMap["first.css"].StoragePath))
+}
+
+func (s *StorageTestSuite) TestCollectStatic_OutputNotWritable() {
+	if runtime.GOOS == "windows" {
+		s.T().Skip("directory permissions are not supported")
+	}
+
+	outputDir := filepath.Join(s.OutputRootDir, "read_only")
+	err := os.MkdirAll(outputDir, 0755)
+	s.Require().NoError(err)
+
+	err = os.Chmod(outputDir, 0555)
+	s.Require().NoError(err)
+	defer os.Chmod(outputDir, 0755)
+
+	// Privileged users can write regardless of the permissions
+	if f, err := ioutil.TempFile(outputDir, "probe"); err == nil {
+		f.Close()
+		os.Remove(f.Name())
+		s.T().Skip("directory permissions are not enforced")
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Equal(ErrOutputNotWritable, err)
+
+	storage, err = NewStorage(filepath.Join(outputDir, "subdir"))
+	s.Require().NoError(err)
+
+	err = storage.CollectStatic()
+	s.Equal(ErrOutputNotWritable, err)
+}
+
+func (s *StorageTestSuite) TestPostProcess() {
+	suffix := "base"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+	expectedDir := filepath.Join(s.ExpectedRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	files1, err := s.listDir(expectedDir)
+	s.Require().NoError(err)
+
+	for _, relPath := range files1 {
+		stat, err := os.Stat(filepath.Join(expectedDir, relPath))
+		s.Require().NoError(err)
+		if stat.IsDir() {
+			continue
+		}
+
+		expPath := filepath.Join(expectedDir, relPath)
+		outPath := filepath.Join(outputDir, relPath)
+
+		s.Require().True(
+			s.compareFiles(expPath, outPath),
+			"The files content of `%s` and `%s` differs from each other", expPath, outPath,
+		)
+	}
+}
+
+func (s *StorageTestSuite) TestRegisterGlobalRule() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "global_rule")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	processed := 0
+	storage.RegisterRule(func(storage *Storage, file *StaticFile) error {
+		processed++
+		return nil
+	})
+	storage.RegisterGlobalRule(func(storage *Storage) error {
+		// Per-file rules are applied before
+		s.Equal(len(storage.FilesMap), processed)
+
+		var relPaths []string
+		for relPath := range storage.FilesMap {
+			relPaths = append(relPaths, relPath)
+		}
+		sort.Strings(relPaths)
+
+		index := strings.Join(relPaths, "\n")
+		return ioutil.WriteFile(filepath.Join(storage.OutputDir, "index.txt"), []byte(index), 0644)
+	})
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, "index.txt"))
+	s.Require().NoError(err)
+	s.Equal("css/import.css\ncss/style.css\ncss/style.css.map\nimg/pix.png", string(content))
+}
+
+func (s *StorageTestSuite) TestAddProcessedFile() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "add_processed_file")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Workers = 2
+
+	var lock sync.Mutex
+	var processed []string
+	storage.RegisterConcurrentRule(func(storage *Storage, file *StaticFile) error {
+		lock.Lock()
+		processed = append(processed, file.RelPath)
+		lock.Unlock()
+
+		if file.RelPath == "css/style.css" {
+			return storage.AddProcessedFile("css/style.min.css", []byte("div{}"))
+		}
+		return nil
+	})
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Derived file is processed after the collected ones
+	s.Len(processed, 5)
+	s.Equal("css/style.min.css", processed[4])
+
+	sf, ok := storage.FilesMap["css/style.min.css"]
+	s.Require().True(ok)
+	s.Equal("css/style.min.css", sf.RelPath)
+	s.Equal("css/style.min.6fc163fedcc5.css", sf.StorageRelPath)
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, sf.StorageRelPath))
+	s.Require().NoError(err)
+	s.Equal("div{}", string(content))
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Equal("css/style.min.6fc163fedcc5.css", storage.Resolve("css/style.min.css"))
+}
+
+func (s *StorageTestSuite) TestRegisterRuleForPattern() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "rule_for_pattern"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	var processed []string
+	storage.RegisterRuleForPattern("css/**/*.css", func(storage *Storage, file *StaticFile) error {
+		processed = append(processed, file.RelPath)
+		return nil
+	})
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	sort.Strings(processed)
+	s.Equal([]string{"css/import.css", "css/style.css"}, processed)
+}
+
+func (s *StorageTestSuite) TestRegisterRuleWithPriority() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "rule_priority"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	var calls []string
+	record := func(name string) PostProcessRule {
+		return func(storage *Storage, file *StaticFile) error {
+			if file.RelPath != "css/style.css" {
+				return nil
+			}
+
+			content, err := ioutil.ReadFile(file.StoragePath)
+			if err != nil {
+				return err
+			}
+
+			// PostProcessCSS is registered with zero priority
+			rewritten := strings.Contains(string(content), "pix.3eaf17869bb5.png")
+			calls = append(calls, name+":"+strconv.FormatBool(rewritten))
+			return nil
+		}
+	}
+
+	storage.RegisterRuleWithPriority(record("late"), 10)
+	storage.RegisterRuleWithPriority(record("early"), -5)
+	storage.RegisterRule(record("default"))
+	storage.RegisterRuleWithPriority(record("last"), 10)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal([]string{"early:false", "default:true", "late:true", "last:true"}, calls)
+}
+
+func (s *StorageTestSuite) TestMatchPath() {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"vendor/**/*.css", "vendor/style.css", true},
+		{"vendor/**/*.css", "vendor/lib/css/style.css", true},
+		{"vendor/**/*.css", "vendor/lib/style.js", false},
+		{"vendor/**/*.css", "css/vendor/style.css", false},
+		{"**/*.css", "style.css", true},
+		{"**", "css/style.css", true},
+		{"css/*.css", "css/lib/style.css", false},
+		{"css/[", "css/[", false},
+	}
+
+	for _, c := range cases {
+		s.Equal(c.match, matchPath(c.pattern, c.name), "%s %s", c.pattern, c.name)
+	}
+}
+
+func (s *StorageTestSuite) TestPostProcess_Parallel() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	serialDir := filepath.Join(s.OutputRootDir, "parallel/serial")
+	parallelDir := filepath.Join(s.OutputRootDir, "parallel/parallel")
+
+	storage, err := NewStorage(serialDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(parallelDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Workers = 4
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	files1, err := s.listDir(serialDir)
+	s.Require().NoError(err)
+
+	files2, err := s.listDir(parallelDir)
+	s.Require().NoError(err)
+	s.Require().Equal(files1, files2)
+
+	for _, relPath := range files1 {
+		serialPath := filepath.Join(serialDir, relPath)
+		parallelPath := filepath.Join(parallelDir, relPath)
+
+		stat, err := os.Stat(serialPath)
+		s.Require().NoError(err)
+		if stat.IsDir() {
+			continue
+		}
+
+		s.Require().True(
+			s.compareFiles(serialPath, parallelPath),
+			"The files content of `%s` and `%s` differs from each other", serialPath, parallelPath,
+		)
+	}
+}
+
+func (s *StorageTestSuite) TestPostProcess_UpdateFile() {
+	suffix := "update"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	// Truncate image file
+	imgPath := filepath.Join(inputDir, "pix.png")
+	f, err := os.OpenFile(imgPath, os.O_RDWR|os.O_TRUNC, 0644)
+	s.Require().NoError(err)
+	f.Close()
+
+	// Collect files as usual
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Compare content of the css file with expected one
+	s.Require().True(s.compareFiles(
+		filepath.Join(outputDir, storage.Resolve("style.css")),
+		filepath.Join(s.ExpectedRootDir, suffix+"/style.before.css")),
+	)
+
+	// Change content of the image referenced in css file
+	err = ioutil.WriteFile(imgPath, []byte("abc"), 0644)
+	s.Require().NoError(err)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Image reference is expected to change
+	s.Require().True(s.compareFiles(
+		filepath.Join(outputDir, storage.Resolve("style.css")),
+		filepath.Join(s.ExpectedRootDir, suffix+"/style.after.css")),
+	)
+}
+
+func (s *StorageTestSuite) TestPin() {
+	inputDir := filepath.Join(s.OutputRootDir, "pin/input")
+	outputDir := filepath.Join(s.OutputRootDir, "pin/output")
+
+	err := os.MkdirAll(filepath.Join(inputDir, "js"), 0755)
+	s.Require().NoError(err)
+
+	scriptPath := filepath.Join(inputDir, "js/widget.js")
+	err = ioutil.WriteFile(scriptPath, []byte("widget();"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Pin("js/widget.js", "widget.v1.js")
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("js/widget.v1.js", storage.Resolve("js/widget.js"))
+
+	// Whitespace change doesn't affect the pinned name, but the content is updated
+	err = ioutil.WriteFile(scriptPath, []byte("widget();\n"), 0644)
+	s.Require().NoError(err)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("js/widget.v1.js", storage.Resolve("js/widget.js"))
+	s.True(s.compareFiles(scriptPath, filepath.Join(outputDir, "js/widget.v1.js")))
+
+	// Pinned flag is recorded in the manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.True(storage.FilesMap["js/widget.js"].Pinned)
+	s.Equal("js/widget.v1.js", storage.Resolve("js/widget.js"))
+}
+
+func (s *StorageTestSuite) TestAddInputDirAs() {
+	outputDir := filepath.Join(s.OutputRootDir, "input_prefix")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDirAs(filepath.Join(s.InputRootDir, "base"), "app")
+	storage.AddInputDirAs(filepath.Join(s.InputRootDir, "ignore_file"), "admin/")
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal("app/css/style.98718311206c.css", storage.Resolve("app/css/style.css"))
+	s.Equal("app/img/pix.3eaf17869bb5.png", storage.Resolve("app/img/pix.png"))
+	s.Equal("admin/css/style.2c2ef5412016.css", storage.Resolve("admin/css/style.css"))
+	s.NotContains(storage.FilesMap, "css/style.css")
+
+	for _, relPath := range []string{"app/css/style.css", "admin/css/style.css"} {
+		storagePath := filepath.Join(outputDir, storage.Resolve(relPath))
+		s.FileExists(storagePath)
+	}
+
+	// References are rewritten within the prefix
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, "app/css/style.98718311206c.css"))
+	s.Require().NoError(err)
+	s.Contains(string(content), "import.5f15d96d5cdb.css")
+}
+
+func (s *StorageTestSuite) TestCollectStatic_StoragePathCollision() {
+	suffix := "collision"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Pin("a.js", "script.js")
+	storage.Pin("b.js", "script.js")
+
+	err = storage.CollectStatic()
+	s.Require().Error(err)
+
+	collisionErr, ok := err.(*StoragePathCollisionError)
+	s.Require().True(ok, "Unexpected error type %T", err)
+	s.Equal(filepath.ToSlash(filepath.Join(outputDir, "script.js")), collisionErr.StoragePath)
+	s.Equal([2]string{
+		filepath.ToSlash(filepath.Join(inputDir, "a.js")),
+		filepath.ToSlash(filepath.Join(inputDir, "b.js")),
+	}, collisionErr.Paths)
+
+	// First file is kept untouched
+	s.True(s.compareFiles(filepath.Join(inputDir, "a.js"), filepath.Join(outputDir, "script.js")))
+}
+
+func (s *StorageTestSuite) TestPostProcess_BrokenURL() {
+	suffix := "broken_url"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	// Collect files as usual
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Require().True(s.compareFiles(
+		filepath.Join(outputDir, storage.Resolve("style.css")),
+		filepath.Join(inputDir, "style.css")),
+	)
+}
+
+func (s *StorageTestSuite) TestPostProcess_URLRewriteFallback() {
+	suffix := "broken_url"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, "url_rewrite_fallback")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	var rawURLs []string
+	storage.URLRewriteFallback = func(rawURL string) (string, bool) {
+		rawURLs = append(rawURLs, rawURL)
+		return "https://cdn.example.com/" + rawURL, true
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal([]string{"pix.png"}, rawURLs)
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("style.css")))
+	s.Require().NoError(err)
+	s.Equal("div {\n    background: url(\"https://cdn.example.com/pix.png\");\n}\n", string(content))
+
+	// Declined references are left unchanged
+	outputDir = filepath.Join(s.OutputRootDir, "url_rewrite_fallback_declined")
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.URLRewriteFallback = func(rawURL string) (string, bool) {
+		return "", false
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.True(s.compareFiles(
+		filepath.Join(outputDir, storage.Resolve("style.css")),
+		filepath.Join(inputDir, "style.css")),
+	)
+}
+
+func (s *StorageTestSuite) TestPostProcessTemplate() {
+	suffix := "template"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.RegisterRule(PostProcessTemplate)
+	storage.TemplateVars = map[string]string{
+		"CDN_HOST": "https://cdn.example.com",
+		"VERSION":  "1.2.3",
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal("style.48bdd3498eba.css", storage.Resolve("style.css"))
+	s.Require().True(s.compareFiles(
+		filepath.Join(outputDir, storage.Resolve("style.css")),
+		filepath.Join(s.ExpectedRootDir, suffix+"/style.css")),
+	)
+
+	// Original hashed file is replaced with the substituted one
+	_, err = os.Stat(filepath.Join(outputDir, "style.045abd5540c6.css"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *StorageTestSuite) TestRegisterImageOptimizers() {
+	inputDir := filepath.Join(s.OutputRootDir, "image_optimizers/input")
+	outputDir := filepath.Join(s.OutputRootDir, "image_optimizers/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	files := map[string]string{
+		"style.css": `div { background: url("pix.png"); }`,
+		"pix.png":   "png-sentinel",
+		"photo.jpg": "jpg",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		s.Require().NoError(err)
+	}
+
+	var optimized []string
+	fakeOptimizer := func(content []byte) ([]byte, error) {
+		optimized = append(optimized, string(content))
+		return bytes.TrimSuffix(content, []byte("-sentinel")), nil
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.RegisterImageOptimizers(fakeOptimizer, fakeOptimizer)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	sort.Strings(optimized)
+	s.Equal([]string{"jpg", "png-sentinel"}, optimized)
+
+	// The storage file is rehashed from the optimized content
+	pixPath := storage.Resolve("pix.png")
+	s.Equal("pix.bff139fa05ac.png", pixPath)
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, pixPath))
+	s.Require().NoError(err)
+	s.Equal("png", string(content))
+
+	_, err = os.Stat(filepath.Join(outputDir, "pix.bbae3153c19b.png"))
+	s.True(os.IsNotExist(err))
+
+	// Unchanged images keep their names
+	s.Equal("photo.c36bbd258b7e.jpg", storage.Resolve("photo.jpg"))
+
+	// References are rewritten with the optimized names
+	content, err = ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("style.css")))
+	s.Require().NoError(err)
+	s.Equal(`div { background: url("pix.bff139fa05ac.png"); }`, string(content))
+
+	// Images are copied again and optimized by each collection
+	optimized = nil
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Len(optimized, 2)
+	s.Equal("pix.bff139fa05ac.png", storage.Resolve("pix.png"))
+
+	// The rule is limited with a pattern
+	outputDir = filepath.Join(s.OutputRootDir, "image_optimizers/output_pattern")
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.RegisterRuleForPattern("*.jpg", ImageOptimizerRule(fakeOptimizer, fakeOptimizer))
+
+	optimized = nil
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal([]string{"jpg"}, optimized)
+	s.Equal("pix.bbae3153c19b.png", storage.Resolve("pix.png"))
+}
+
+func (s *StorageTestSuite) TestAddTransform() {
+	inputDir := filepath.Join(s.OutputRootDir, "transform/input")
+	outputDir := filepath.Join(s.OutputRootDir, "transform/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	files := map[string]string{
+		"style.css": `div { background: url("pix.png"); }`,
+		"pix.png":   "png",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.AddTransform(".CSS", func(content []byte) ([]byte, error) {
+		return append([]byte("/* License */\n"), content...), nil
+	})
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	transformed := "/* License */\n" + files["style.css"]
+	sum := md5.Sum([]byte(transformed))
+	hash := hex.EncodeToString(sum[:])[:12]
+	s.Equal("style."+hash+".css", storage.Resolve("style.css"))
+	s.Equal("pix.bff139fa05ac.png", storage.Resolve("pix.png"))
+
+	fingerprint, err := storage.Fingerprint("style.css")
+	s.Require().NoError(err)
+	s.Equal(hash, fingerprint)
+
+	// Post-processing rules get the transformed content
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("style.css")))
+	s.Require().NoError(err)
+	s.Equal("/* License */\n"+`div { background: url("pix.bff139fa05ac.png"); }`, string(content))
+
+	// Transform errors stop the collection
+	transformErr := errors.New("transform failed")
+	storage.AddTransform(".css", func(content []byte) ([]byte, error) {
+		return nil, transformErr
+	})
+	err = storage.CollectStatic()
+	s.Equal(transformErr, err)
+}
+
+func (s *StorageTestSuite) TestAddNoProcessPattern() {
+	inputDir := filepath.Join(s.OutputRootDir, "no_process/input")
+	outputDir := filepath.Join(s.OutputRootDir, "no_process/output")
+
+	err := os.MkdirAll(filepath.Join(inputDir, "vendor/lib"), 0755)
+	s.Require().NoError(err)
+
+	css := `div { background: url("../../pix.png"); }`
+	files := map[string]string{
+		"vendor/lib/bundle.css": css,
+		"css/style.css":         `div { background: url("../pix.png"); }`,
+		"pix.png":               "png",
+	}
+	for name, content := range files {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(inputDir, name)), 0755)
+		s.Require().NoError(err)
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.AddNoProcessPattern("vendor/**")
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("vendor/lib/bundle.css")))
+	s.Require().NoError(err)
+	s.Equal(css, string(content))
+
+	content, err = ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("css/style.css")))
+	s.Require().NoError(err)
+	s.Equal(`div { background: url("../pix.bff139fa05ac.png"); }`, string(content))
+}
+
+func (s *StorageTestSuite) TestHashDependencies() {
+	inputDir := filepath.Join(s.OutputRootDir, "hash_dependencies/input")
+	outputDir := filepath.Join(s.OutputRootDir, "hash_dependencies/output")
+	imgPath := filepath.Join(inputDir, "pix.png")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	files := map[string]string{
+		"style.css":  `@import "import.css";`,
+		"import.css": `div { background: url("pix.png"); }`,
+		"pix.png":    "png",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.HashDependencies = true
+	storage.Workers = 4
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	styleName := storage.Resolve("style.css")
+	importName := storage.Resolve("import.css")
+
+	// Only the referenced image is changed
+	err = ioutil.WriteFile(imgPath, []byte("abc"), 0644)
+	s.Require().NoError(err)
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal("pix.900150983cd2.png", storage.Resolve("pix.png"))
+	s.NotEqual(importName, storage.Resolve("import.css"))
+	s.NotEqual(styleName, storage.Resolve("style.css"))
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("style.css")))
+	s.Require().NoError(err)
+	s.Equal(`@import "`+storage.Resolve("import.css")+`";`, string(content))
+
+	// Incremental rebuilds update the indirect referrers too
+	styleName = storage.Resolve("style.css")
+	err = ioutil.WriteFile(imgPath, []byte("png"), 0644)
+	s.Require().NoError(err)
+	err = storage.rebuild([]string{imgPath}, nil)
+	s.Require().NoError(err)
+	s.NotEqual(styleName, storage.Resolve("style.css"))
+
+	content, err = ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("import.css")))
+	s.Require().NoError(err)
+	s.Equal(`div { background: url("pix.bff139fa05ac.png"); }`, string(content))
+}
+
+func (s *StorageTestSuite) TestPostProcess_CircularImport() {
+	suffix := "circular_import"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	// Browsers tolerate the circular imports
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Imported files can't be processed first
+	storage.HashDependencies = true
+	err = storage.CollectStatic()
+	s.Require().Error(err)
+
+	cycleErr, ok := err.(*ImportCycleError)
+	s.Require().True(ok, "Unexpected error type %T", err)
+	s.Equal([]string{"a.css", "b.css", "a.css"}, cycleErr.Cycle)
+	s.Equal("circular CSS @import: a.css -> b.css -> a.css", err.Error())
+}
+
+func (s *StorageTestSuite) TestIsBinary() {
+	binary, err := IsBinary("testdata/input/base/img/pix.png")
+	s.Require().NoError(err)
+	s.True(binary)
+
+	binary, err = IsBinary("testdata/input/base/css/style.css")
+	s.Require().NoError(err)
+	s.False(binary)
+
+	_, err = IsBinary("testdata/input/base/file-not-exist")
+	s.True(os.IsNotExist(err))
+}
+
+func (s *StorageTestSuite) TestPostProcess_TextRule() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "text_rule")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	var textFiles, allFiles []string
+	storage.RegisterTextRule(func(storage *Storage, file *StaticFile) error {
+		textFiles = append(textFiles, file.RelPath)
+		return nil
+	})
+	storage.RegisterRule(func(storage *Storage, file *StaticFile) error {
+		allFiles = append(allFiles, file.RelPath)
+		return nil
+	})
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Contains(textFiles, "css/style.css")
+	s.NotContains(textFiles, "img/pix.png")
+	s.Contains(allFiles, "img/pix.png")
+}
+
+func (s *StorageTestSuite) TestQueryStringMode() {
+	suffix := "query"
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.QueryStringMode = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal("css/style.css?v=98718311206c", storage.Resolve("css/style.css"))
+	s.Require().True(s.compareFiles(
+		filepath.Join(outputDir, "css/style.css"),
+		filepath.Join(s.ExpectedRootDir, suffix+"/css/style.css")),
+	)
+
+	// Hashes are restored from the manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Equal("img/pix.png?v=3eaf17869bb5", storage.Resolve("img/pix.png"))
+
+	// Only the URLs with the current hash are immutable
+	cases := map[string]string{
+		"/img/pix.png?v=3eaf17869bb5": DefaultCacheControl,
+		"/img/pix.png?v=0123456789ab": RevalidateCacheControl,
+		"/img/pix.png":                RevalidateCacheControl,
+	}
+	handler := storage.Handler()
+	for url, cacheControl := range cases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+
+		s.Equal(http.StatusOK, rec.Code)
+		s.Equal(cacheControl, rec.Header().Get("Cache-Control"), url)
+	}
+}
+
+func (s *StorageTestSuite) TestGzip_SkipIncompressible() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "gzip")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Gzip = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	_, err = os.Stat(filepath.Join(outputDir, storage.Resolve("css/style.css")+GzipExt))
+	s.NoError(err)
+
+	_, err = os.Stat(filepath.Join(outputDir, storage.Resolve("img/pix.png")+GzipExt))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *StorageTestSuite) TestCompressedSize() {
+	outputDir := filepath.Join(s.OutputRootDir, "compressed_size")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.Gzip = true
+	storage.Brotli = func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Reload storage to make sure the sizes are read from the manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+
+	storagePath := filepath.Join(outputDir, storage.Resolve("css/style.css"))
+	stat, err := os.Stat(storagePath)
+	s.Require().NoError(err)
+	gzStat, err := os.Stat(storagePath + GzipExt)
+	s.Require().NoError(err)
+	brStat, err := os.Stat(storagePath + BrotliExt)
+	s.Require().NoError(err)
+
+	s.Equal(stat.Size(), storage.FilesMap["css/style.css"].Size)
+	s.Equal(gzStat.Size(), storage.CompressedSize("css/style.css", GzipEncoding))
+	s.Equal(brStat.Size(), storage.CompressedSize("css/style.css", BrotliEncoding))
+	s.NotEqual(gzStat.Size(), brStat.Size())
+	s.Equal(int64(0), storage.CompressedSize("css/style.css", "deflate"))
+
+	// Incompressible files have the raw size only
+	s.Equal(int64(67), storage.FilesMap["img/pix.png"].Size)
+	s.Equal(int64(0), storage.CompressedSize("img/pix.png", GzipEncoding))
+	s.Equal(int64(0), storage.CompressedSize("img/pix.png", BrotliEncoding))
+	s.Equal(int64(0), storage.CompressedSize("missing.css", GzipEncoding))
+}
+
+func (s *StorageTestSuite) TestBrotli() {
+	outputDir := filepath.Join(s.OutputRootDir, "brotli")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.Brotli = func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storagePath := filepath.Join(outputDir, storage.Resolve("css/style.css"))
+	f, err := os.Open(storagePath + BrotliExt)
+	s.Require().NoError(err)
+	defer f.Close()
+
+	zr, err := zlib.NewReader(f)
+	s.Require().NoError(err)
+	content, err := ioutil.ReadAll(zr)
+	s.Require().NoError(err)
+
+	expected, err := ioutil.ReadFile(storagePath)
+	s.Require().NoError(err)
+	s.Equal(expected, content)
+
+	// Only the enabled encodings are written
+	_, err = os.Stat(storagePath + GzipExt)
+	s.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(outputDir, storage.Resolve("img/pix.png")+BrotliExt))
+	s.True(os.IsNotExist(err))
+
+	// Command errors are returned
+	for _, name := range []string{"false", "staticfiles-missing-command"} {
+		storage.Brotli = CommandEncoder(name)
+		err = storage.CollectStatic()
+		s.Error(err, name)
+	}
+}
+
+func (s *StorageTestSuite) TestGzip_CompressibleExtensions() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "gzip_compressible")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Gzip = true
+	storage.CompressibleExtensions = []string{".MAP"}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	_, err = os.Stat(filepath.Join(outputDir, storage.Resolve("css/style.css.map")+GzipExt))
+	s.NoError(err)
+
+	_, err = os.Stat(filepath.Join(outputDir, storage.Resolve("css/style.css")+GzipExt))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *StorageTestSuite) TestContentAddressed() {
+	suffix := "content_addressed"
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.ContentAddressed = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	files, err := s.listDir(outputDir)
+	s.Require().NoError(err)
+	s.Equal([]string{
+		"/3eaf17869bb5.png",
+		"/8a80554c91d9.map",
+		"/959053b9ac4a.css",
+		"/96ad8cb20fad.css",
+		"/" + ManifestFilename,
+	}, files)
+
+	// CSS files are named by the content with the rewritten references
+	s.Equal("96ad8cb20fad.css", storage.Resolve("css/style.css"))
+	s.Equal("959053b9ac4a.css", storage.Resolve("css/import.css"))
+	s.Require().True(s.compareFiles(
+		filepath.Join(outputDir, "96ad8cb20fad.css"),
+		filepath.Join(s.ExpectedRootDir, suffix+"/96ad8cb20fad.css")),
+	)
+}
+
+func (s *StorageTestSuite) TestContentAddressed_SameSource() {
+	inputDir := filepath.Join(s.OutputRootDir, "content_addressed_same_source/input")
+	outputDir := filepath.Join(s.OutputRootDir, "content_addressed_same_source/output")
+
+	for _, dir := range []string{"a", "b"} {
+		err := os.MkdirAll(filepath.Join(inputDir, dir), 0755)
+		s.Require().NoError(err)
+		err = ioutil.WriteFile(filepath.Join(inputDir, dir, "s.css"), []byte(`div { background: url("pix.png"); }`), 0644)
+		s.Require().NoError(err)
+		err = ioutil.WriteFile(filepath.Join(inputDir, dir, "pix.png"), []byte(dir), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.ContentAddressed = true
+	storage.Workers = 4
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Files with the same source don't share the storage file,
+	// since their references point to the different images
+	for _, dir := range []string{"a", "b"} {
+		content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve(dir+"/s.css")))
+		s.Require().NoError(err)
+		s.Equal(`div { background: url("`+storage.Resolve(dir+"/pix.png")+`"); }`, string(content))
+	}
+	s.NotEqual(storage.Resolve("a/s.css"), storage.Resolve("b/s.css"))
+	s.NoError(storage.Verify())
+
+	// Files with the same rewritten content share it
+	err = ioutil.WriteFile(filepath.Join(inputDir, "b/pix.png"), []byte("a"), 0644)
+	s.Require().NoError(err)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal(storage.Resolve("a/s.css"), storage.Resolve("b/s.css"))
+	s.NoError(storage.Verify())
+}
+
+func (s *StorageTestSuite) TestHashLength_Collision() {
+	inputDir := filepath.Join(s.OutputRootDir, "hash_collision/input")
+	outputDir := filepath.Join(s.OutputRootDir, "hash_collision/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.ContentAddressed = true
+	storage.HashLength = 1
+
+	// Find two contents with the same truncated hash sum
+	seen := make(map[string]string)
+	var contents [2]string
+	for i := 0; contents[0] == ""; i++ {
+		content := "div { order: " + strconv.Itoa(i) + " }"
+		sum := md5.Sum([]byte(content))
+		hash := storage.formatHash(sum[:])
+
+		if prev, ok := seen[hash]; ok {
+			contents = [2]string{prev, content}
+		}
+		seen[hash] = content
+	}
+
+	for i, name := range []string{"a.css", "b.css"} {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(contents[i]), 0644)
+		s.Require().NoError(err)
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	first := storage.FilesMap["a.css"].StorageRelPath
+	second := storage.FilesMap["b.css"].StorageRelPath
+	s.NotEqual(first, second)
+	s.Len(first, len("0.css"))
+	s.Len(second, len("00.css"))
+	s.Equal(first[:1], second[:1])
+
+	for i, name := range []string{"a.css", "b.css"} {
+		content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve(name)))
+		s.Require().NoError(err)
+		s.Equal(contents[i], string(content))
+	}
+}
+
+func (s *StorageTestSuite) TestVersionSegment() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "version_segment")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.VersionSegment = "v/1234"
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	files, err := s.listDir(filepath.Join(outputDir, "v/1234"))
+	s.Require().NoError(err)
+	s.Equal([]string{"/css", "/css/import.css", "/css/style.css", "/css/style.css.map", "/img", "/img/pix.png"}, files)
+
+	s.Equal("v/1234/css/style.css", storage.Resolve("css/style.css"))
+
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, ManifestFilename))
+	s.Require().NoError(err)
+	s.Contains(string(data), `"version_segment":"v/1234"`)
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Equal("v/1234/img/pix.png", storage.Resolve("img/pix.png"))
+}
+
+func (s *StorageTestSuite) TestVersionFunc() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "version_func")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.VersionSegment = "v"
+
+	commit := "3f2a9c1"
+	storage.VersionFunc = func() (string, error) {
+		return commit, nil
+	}
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("v/3f2a9c1/css/style.css", storage.Resolve("css/style.css"))
+
+	_, err = os.Stat(filepath.Join(outputDir, "v/3f2a9c1/img/pix.png"))
+	s.NoError(err)
+
+	commit = "8b4e0d7"
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Equal("v/8b4e0d7/css/style.css", storage.Resolve("css/style.css"))
+
+	commit = "../.."
+	err = storage.CollectStatic()
+	s.Equal(ErrInvalidVersion, err)
+
+	versionErr := errors.New("not a git repository")
+	storage.VersionFunc = func() (string, error) {
+		return "", versionErr
+	}
+	err = storage.CollectStatic()
+	s.Equal(versionErr, err)
+}
+
+func (s *StorageTestSuite) TestRebuildManifestFromOutput() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "rebuild_manifest")
+	expectedDir := filepath.Join(s.ExpectedRootDir, "base")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Gzip = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	err = os.Remove(filepath.Join(outputDir, ManifestFilename))
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Empty(storage.FilesMap)
+
+	err = storage.RebuildManifestFromOutput()
+	s.Require().NoError(err)
+
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal("css/style.css.8a80554c91d9.map", storage.Resolve("css/style.css.map"))
+	s.Equal("img/pix.3eaf17869bb5.png", storage.Resolve("img/pix.png"))
+	s.Len(storage.FilesMap, 4)
+
+	s.True(s.compareFiles(
+		filepath.Join(outputDir, ManifestFilename),
+		filepath.Join(expectedDir, ManifestFilename),
+	))
+
+	storage.ContentAddressed = true
+	s.Equal(ErrManifestNotRebuildable, storage.RebuildManifestFromOutput())
+}
+
+func (s *StorageTestSuite) TestRebuildManifestFromOutput_QueryStringMode() {
+	outputDir := filepath.Join(s.OutputRootDir, "rebuild_manifest_query")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.QueryStringMode = true
+	storage.Gzip = true
+	storage.EmitLatestAlias = true
+	storage.WriteChangeLog = true
+	storage.ManifestChecksum = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.QueryStringMode = true
+
+	err = storage.RebuildManifestFromOutput()
+	s.Require().NoError(err)
+
+	// Storage metadata files and latest copies aren't the assets
+	var relPaths []string
+	for relPath := range storage.FilesMap {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+	s.Equal([]string{"css/import.css", "css/style.css", "css/style.css.map", "img/pix.png"}, relPaths)
+}
+
+func (s *StorageTestSuite) TestRecordContentType() {
+	outputDir := filepath.Join(s.OutputRootDir, "content_type")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.RecordContentType = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Reload storage to make sure the types are read from the manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+
+	s.Equal("text/css; charset=utf-8", storage.ContentType("css/style.css"))
+	s.Equal("image/png", storage.ContentType("img/pix.png"))
+	s.Equal("", storage.ContentType("file-not-exist"))
+
+	// Older manifests have no types
+	storage, err = NewStorage("testdata/input/storage_disabled/output")
+	s.Require().NoError(err)
+	s.Equal("style.123.css", storage.Resolve("style.css"))
+	s.Equal("", storage.ContentType("style.css"))
+}
+
+func (s *StorageTestSuite) TestResolve_CollectStatic() {
+	storage, err := NewStorage("testdata/output/base")
+	s.Require().NoError(err)
+	storage.AddInputDir("testdata/input/base")
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal("", storage.Resolve("file-not-exist"))
+}
+
+func (s *StorageTestSuite) TestResolve_LoadManifest() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal("", storage.Resolve("file-not-exist"))
+}
+
+func (s *StorageTestSuite) TestResolve_LeadingSlash() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal("css/style.98718311206c.css", storage.Resolve("/css/style.css"))
+
+	storagePath, err := storage.ResolveE("/css/style.css")
+	s.NoError(err)
+	s.Equal("css/style.98718311206c.css", storagePath)
+}
+
+func (s *StorageTestSuite) TestURLForStorageRelPath() {
+	storage, err := NewStorage(filepath.Join(s.ExpectedRootDir, "base"))
+	s.Require().NoError(err)
+
+	s.Equal("/css/style.98718311206c.css", storage.URLForStorageRelPath("css/style.98718311206c.css"))
+
+	for _, staticURL := range []string{"https://cdn.example.com/static", "https://cdn.example.com/static/"} {
+		storage.StaticURL = staticURL
+		s.Equal("https://cdn.example.com/static/css/style.98718311206c.css", storage.URLForStorageRelPath("css/style.98718311206c.css"), staticURL)
+		s.Equal("https://cdn.example.com/static/img/pix.3eaf17869bb5.png", storage.URLForStorageRelPath("/img/pix.3eaf17869bb5.png"), staticURL)
+	}
+}
+
+func (s *StorageTestSuite) TestResolveURLWith() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	cases := map[string]string{
+		"https://a.cdn.example.com":  "https://a.cdn.example.com/css/style.98718311206c.css",
+		"https://b.cdn.example.com/": "https://b.cdn.example.com/css/style.98718311206c.css",
+		"//cdn.example.com/static":   "//cdn.example.com/static/css/style.98718311206c.css",
+		"":                           "/css/style.98718311206c.css",
+	}
+	for prefix, expected := range cases {
+		s.Equal(expected, storage.ResolveURLWith(prefix, "css/style.css"), prefix)
+		s.Equal(expected, storage.ResolveURLWith(prefix, "/css/style.css"), prefix)
+	}
+
+	s.Equal("", storage.ResolveURLWith("https://a.cdn.example.com", "file-not-exist"))
+}
+
+func (s *StorageTestSuite) TestAlias() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+	storage.Alias("main-css", "css/style.css")
+
+	s.Equal("css/style.98718311206c.css", storage.Resolve("main-css"))
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal("https://cdn.example.com/css/style.98718311206c.css", storage.ResolveURLWith("https://cdn.example.com", "main-css"))
+
+	storagePath, err := storage.ResolveE("main-css")
+	s.NoError(err)
+	s.Equal("css/style.98718311206c.css", storagePath)
+
+	storage.Enabled = false
+	s.Equal("css/style.css", storage.Resolve("main-css"))
+}
+
+func (s *StorageTestSuite) TestResolveRelative() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	s.Equal("img/pix.3eaf17869bb5.png", storage.ResolveRelative("css/style.css", "../img/pix.png"))
+	s.Equal("img/pix.3eaf17869bb5.png", storage.ResolveRelative("/css/style.css", "../img/pix.png"))
+	s.Equal("img/pix.3eaf17869bb5.png", storage.ResolveRelative("css/style.css", "/img/pix.png"))
+	s.Equal("css/style.98718311206c.css", storage.ResolveRelative("css/import.css", "style.css"))
+	s.Equal("", storage.ResolveRelative("css/style.css", "img/pix.png"))
+}
+
+func (s *StorageTestSuite) TestResolveWithExtFallback() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	s.Equal("css/style.98718311206c.css", storage.ResolveWithExtFallback("css/style", ".js", ".css"))
+	s.Equal("css/style.98718311206c.css", storage.ResolveWithExtFallback("css/style", "css"))
+	s.Equal("css/style.98718311206c.css", storage.ResolveWithExtFallback("css/style.css", ".js"))
+	s.Equal("", storage.ResolveWithExtFallback("css/style", ".js"))
+
+	storage.Enabled = false
+	storage.AddInputDir("testdata/input/base")
+	s.Equal("css/style.css", storage.ResolveWithExtFallback("css/style", ".js", ".css"))
+	s.Equal("css/style", storage.ResolveWithExtFallback("css/style", ".js"))
+}
+
+func (s *StorageTestSuite) TestResolve_StorageDisabled() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+	storage.Enabled = false
+
+	s.Equal("css/style.css", storage.Resolve("css/style.css"))
+	s.Equal("null", storage.Resolve("null"))
+}
+
+func (s *StorageTestSuite) TestResolveE() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	storagePath, err := storage.ResolveE("css/style.css")
+	s.NoError(err)
+	s.Equal("css/style.98718311206c.css", storagePath)
+
+	storagePath, err = storage.ResolveE("file-not-exist")
+	s.Equal(ErrAssetNotFound, err)
+	s.Equal("", storagePath)
+
+	storage.Enabled = false
+	storagePath, err = storage.ResolveE("file-not-exist")
+	s.NoError(err)
+	s.Equal("file-not-exist", storagePath)
+}
+
+func (s *StorageTestSuite) TestResolve_CaseInsensitive() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	s.Equal("", storage.Resolve("CSS/Style.css"))
+
+	storage.CaseInsensitive = true
+	s.Equal("css/style.98718311206c.css", storage.Resolve("CSS/Style.css"))
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/STYLE.CSS"))
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal("", storage.Resolve("CSS/file-not-exist.css"))
+}
+
+func (s *StorageTestSuite) TestResolve_CaseInsensitive_Collision() {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+	storage.CaseInsensitive = true
+	storage.FilesMap = map[string]*StaticFile{
+		"style.css": {RelPath: "style.css", StorageRelPath: "style.1.css"},
+		"Style.css": {RelPath: "Style.css", StorageRelPath: "Style.2.css"},
+	}
+
+	s.Equal("style.1.css", storage.Resolve("style.css"))
+	s.Equal("Style.2.css", storage.Resolve("Style.css"))
+	s.Equal("Style.2.css", storage.Resolve("STYLE.css"))
+	s.Contains(logBuf.String(), "'Style.css' and 'style.css' differ only by case")
+}
+
+func (s *StorageTestSuite) TestOpen_File() {
+	storage, err := NewStorage("testdata/input/base")
+	s.Require().NoError(err)
+
+	f, err := storage.Open("css/style.css")
+	s.Assert().NoError(err)
+	s.Assert().NotNil(f)
+}
+
+func (s *StorageTestSuite) TestOpen_VerifyOnOpen() {
+	outputDir := filepath.Join(s.OutputRootDir, "verify_on_open")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.VerifyOnOpen = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.VerifyOnOpen = true
+
+	// Post-processed file is checked against the recorded digest
+	stylePath := storage.Resolve("css/style.css")
+	f, err := storage.Open("/" + stylePath)
+	s.Require().NoError(err)
+
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	s.Require().NoError(err)
+
+	expected, err := ioutil.ReadFile(filepath.Join(outputDir, stylePath))
+	s.Require().NoError(err)
+	s.Equal(expected, content)
+
+	// Verified file isn't read again until it changes
+	stylePath = filepath.Join(outputDir, stylePath)
+	stat, err := os.Stat(stylePath)
+	s.Require().NoError(err)
+	s.Require().NoError(ioutil.WriteFile(stylePath, bytes.Repeat([]byte{'x'}, int(stat.Size())), 0644))
+	s.Require().NoError(os.Chtimes(stylePath, stat.ModTime(), stat.ModTime()))
+
+	f, err = storage.Open("/" + storage.Resolve("css/style.css"))
+	s.Require().NoError(err)
+	f.Close()
+
+	// File without the digest isn't checked
+	pixPath := filepath.Join(outputDir, storage.Resolve("img/pix.png"))
+	storage.FilesMap["img/pix.png"].Digest = ""
+	s.Require().NoError(ioutil.WriteFile(pixPath, []byte("corrupted"), 0644))
+
+	f, err = storage.Open("/" + storage.Resolve("img/pix.png"))
+	s.Require().NoError(err)
+	f.Close()
+
+	for _, relPath := range []string{"css/style.css", "css/import.css"} {
+		storagePath := filepath.Join(outputDir, storage.Resolve(relPath))
+		f, err := os.OpenFile(storagePath, os.O_APPEND|os.O_WRONLY, 0644)
+		s.Require().NoError(err)
+		_, err = f.WriteString("corrupted")
+		s.Require().NoError(err)
+		f.Close()
+
+		_, err = storage.Open("/" + storage.Resolve(relPath))
+		s.Equal(ErrIntegrityMismatch, err, relPath)
+	}
+
+	storage.VerifyOnOpen = false
+	f, err = storage.Open("/" + storage.Resolve("css/style.css"))
+	s.Require().NoError(err)
+	f.Close()
+}
+
+func (s *StorageTestSuite) TestOpen_File_StorageDisabled() {
+	storage, err := NewStorage("testdata/input/storage_disabled/output")
+	s.Require().NoError(err)
+	storage.AddInputDir("testdata/input/storage_disabled/input")
+
+	storage.Enabled = false
+	f, err := storage.Open("file.css")
+	s.Assert().NoError(err)
+	s.Assert().NotNil(f)
+}
+
+func (s *StorageTestSuite) TestOpen_Dir_IndexFile() {
+	suffix := "index"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, suffix))
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storage.IndexFile = "index.html"
+	storage.OutputDirList = false
+
+	for _, enabled := range []bool{true, false} {
+		storage.Enabled = enabled
+
+		// Directory with the index file
+		f, err := storage.Open("/docs")
+		s.Require().NoError(err)
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		s.Require().NoError(err)
+		s.Equal("<h1>Docs</h1>\n", string(content))
+
+		// Directory without the index file
+		f, err = storage.Open("/css")
+		s.True(os.IsNotExist(err))
+		s.Nil(f)
+	}
+
+	storage.Enabled = true
+	storage.OutputDirList = true
+	f, err := storage.Open("/css")
+	s.Require().NoError(err)
+	defer f.Close()
+
+	stat, err := f.Stat()
+	s.Require().NoError(err)
+	s.True(stat.IsDir())
+}
+
+func (s *StorageTestSuite) TestOpenSource_CollectStatic() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "base"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	f, err := storage.OpenSource("css/style.css")
+	s.Require().NoError(err)
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	s.Require().NoError(err)
+
+	expected, err := ioutil.ReadFile(filepath.Join(s.InputRootDir, "base/css/style.css"))
+	s.Require().NoError(err)
+	s.Equal(expected, content)
+
+	_, err = storage.OpenSource("file-not-exist")
+	s.Equal(os.ErrNotExist, err)
+}
+
+func (s *StorageTestSuite) TestOpenSource_LoadManifest() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	f, err := storage.OpenSource("css/style.css")
+	s.Equal(os.ErrNotExist, err)
+	s.Nil(f)
+}
+
+func (s *StorageTestSuite) TestOpen_Dir_ListEnabled() {
+	storage, err := NewStorage("testdata/input/base")
+	s.Require().NoError(err)
+
+	f, err := storage.Open("css")
+	s.Assert().NoError(err)
+	s.Assert().NotNil(f)
+}
+
+func (s *StorageTestSuite) TestOpen_Dir_ListDisabled() {
+	storage, err := NewStorage("testdata/input/base")
+	s.Require().NoError(err)
+
+	storage.OutputDirList = false
+	for _, name := range []string{"css", "css/", "/css/", "/css//"} {
+		f, err := storage.Open(name)
+		s.Assert().True(os.IsNotExist(err), name)
+		s.Assert().Nil(f, name)
+	}
+
+	// Files are still served
+	f, err := storage.Open("css/style.css")
+	s.Require().NoError(err)
+	f.Close()
+}
+
+func (s *StorageTestSuite) TestResolve_MissingPolicy_ReturnEmpty() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	var missing []string
+	storage.OnMissing = func(relPath string) {
+		missing = append(missing, relPath)
+	}
+
+	s.Equal("", storage.Resolve("file-not-exist"))
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	s.Equal([]string{"file-not-exist"}, missing)
+}
+
+func (s *StorageTestSuite) TestResolve_MissingPolicy_ReturnOriginal() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+	storage.MissingPolicy = ReturnOriginal
+
+	s.Equal("file-not-exist", storage.Resolve("file-not-exist"))
+	s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+}
+
+func (s *StorageTestSuite) TestResolve_MissingPolicy_Panic() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+	storage.MissingPolicy = Panic
+
+	called := false
+	storage.OnMissing = func(relPath string) {
+		called = true
+	}
+
+	s.Panics(func() { storage.Resolve("file-not-exist") })
+	s.True(called)
+	s.NotPanics(func() { storage.Resolve("css/style.css") })
+}
+
+func (s *StorageTestSuite) TestHashAndCopy() {
+	srcPath := "testdata/input/base/css/style.css"
+	dstDir := filepath.Join(s.OutputRootDir, "hash_and_copy")
+	err := os.MkdirAll(dstDir, 0755)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(dstDir)
+	s.Require().NoError(err)
+
+	dst, copied, err := storage.hashAndCopy(srcPath, dstDir, nil)
+	s.Require().NoError(err)
+	s.True(copied)
+	s.Equal(filepath.ToSlash(filepath.Join(dstDir, "style.98718311206c.css")), dst)
+	s.True(s.compareFiles(srcPath, dst))
+
+	// Existing file is kept and no temporary files are left behind
+	dst2, copied, err := storage.hashAndCopy(srcPath, dstDir, nil)
+	s.Require().NoError(err)
+	s.False(copied)
+	s.Equal(dst, dst2)
+
+	files, err := s.listDir(dstDir)
+	s.Require().NoError(err)
+	s.Equal([]string{"/style.98718311206c.css"}, files)
+}
+
+func (s *StorageTestSuite) TestHashAndCopy_StaleCollision() {
+	srcPath := "testdata/input/base/css/style.css"
+	dstDir := filepath.Join(s.OutputRootDir, "hash_and_copy_stale")
+	err := os.MkdirAll(dstDir, 0755)
+	s.Require().NoError(err)
+
+	// File left by the previous build with the same truncated hash sum
+	stalePath := filepath.Join(dstDir, "style.98718311206c.css")
+	err = ioutil.WriteFile(stalePath, []byte("stale"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(dstDir)
+	s.Require().NoError(err)
+
+	dst, copied, err := storage.hashAndCopy(srcPath, dstDir, nil)
+	s.Require().NoError(err)
+	s.True(copied)
+	s.Equal(filepath.ToSlash(filepath.Join(dstDir, "style.98718311206ce.css")), dst)
+	s.True(s.compareFiles(srcPath, dst))
+
+	content, err := ioutil.ReadFile(stalePath)
+	s.Require().NoError(err)
+	s.Equal("stale", string(content))
+
+	// Post-processed storage files of the previous collection keep their names
+	outputDir := filepath.Join(s.OutputRootDir, "hash_and_copy_stale/output")
+	for i := 0; i < 2; i++ {
+		storage, err = NewStorage(outputDir)
+		s.Require().NoError(err)
+		storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+		err = storage.CollectStatic()
+		s.Require().NoError(err)
+		s.Equal("css/style.98718311206c.css", storage.Resolve("css/style.css"))
+	}
+}
+
+func (s *StorageTestSuite) TestFingerprint() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "base"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	for relPath, sf := range storage.FilesMap {
+		fingerprint, err := storage.Fingerprint(relPath)
+		s.Require().NoError(err)
+		s.Contains(filepath.Base(sf.StoragePath), "."+fingerprint, relPath)
+	}
+
+	_, err = storage.Fingerprint("file-not-exist")
+	s.Equal(os.ErrNotExist, err)
+}
+
+func (s *StorageTestSuite) TestHashReader_Chunking() {
+	content, err := ioutil.ReadFile(filepath.Join(s.InputRootDir, "base/css/style.css"))
+	s.Require().NoError(err)
+
+	storage := &Storage{}
+	expected, err := storage.hashReader(bytes.NewReader(content))
+	s.Require().NoError(err)
+	s.Equal("98718311206c", expected)
+
+	readers := []io.Reader{
+		iotest.OneByteReader(bytes.NewReader(content)),
+		iotest.HalfReader(bytes.NewReader(content)),
+		iotest.DataErrReader(bytes.NewReader(content)),
+		io.TeeReader(bytes.NewReader(content), ioutil.Discard),
+	}
+	for _, r := range readers {
+		sum, err := storage.hashReader(r)
+		s.Require().NoError(err)
+		s.Equal(expected, sum)
+	}
+}
+
+func (s *StorageTestSuite) TestHashedName() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "hashed_name"))
+	s.Require().NoError(err)
+
+	cases := map[string]string{
+		"css/style.css":        "css/style.abc.css",
+		"LICENSE":              "LICENSE.abc",
+		".htaccess":            ".htaccess.abc",
+		"conf/.htaccess":       "conf/.htaccess.abc",
+		".eslintrc.json":       ".eslintrc.abc.json",
+		"dist/archive.tar.gz":  "dist/archive.abc.tar.gz",
+		"dist/ARCHIVE.TAR.BZ2": "dist/ARCHIVE.abc.TAR.BZ2",
+		"js/app.min.js":        "js/app.min.abc.js",
+		".tar.gz":              ".tar.abc.gz",
+	}
+	for path, expected := range cases {
+		s.Equal(expected, storage.hashedName(path, "abc"), path)
+	}
+}
+
+func (s *StorageTestSuite) TestCompoundExtensions() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "compound_ext"))
+	s.Require().NoError(err)
+	storage.CompoundExtensions = []string{".tar.gz", ".min.css"}
+
+	s.Equal("css/style.abc.min.css", storage.hashedName("css/style.min.css", "abc"))
+	s.Equal("dist/archive.abc.tar.gz", storage.hashedName("dist/archive.tar.gz", "abc"))
+
+	// Original names are restored from the storage names
+	regex := storage.hashedNameRegex()
+	for _, name := range []string{"style.5f15d96d5cdb.min.css", "archive.5f15d96d5cdb.tar.gz"} {
+		s.Equal("5f15d96d5cdb", findSubmatchGroup(regex, name, "hash"), name)
+	}
+	s.Equal(".min.css", findSubmatchGroup(regex, "style.5f15d96d5cdb.min.css", "ext"))
+	s.Equal(".tar.gz", findSubmatchGroup(regex, "archive.5f15d96d5cdb.tar.gz", "ext"))
+	s.Equal(".css", findSubmatchGroup(regex, "style.5f15d96d5cdb.css", "ext"))
+
+	storage.CompoundExtensions = []string{}
+	s.Equal("dist/archive.tar.abc.gz", storage.hashedName("dist/archive.tar.gz", "abc"))
+}
+
+func (s *StorageTestSuite) TestHashEncoding() {
+	cases := []struct {
+		encoding HashEncoding
+		length   int
+		pattern  *regexp.Regexp
+	}{
+		{Hex, 12, regexp.MustCompile(`^[0-9a-f]+$`)},
+		{Base32, 10, regexp.MustCompile(`^[a-z2-7]+$`)},
+		{Base62, 9, regexp.MustCompile(`^[0-9a-zA-Z]+$`)},
+	}
+
+	for _, c := range cases {
+		storage := &Storage{HashEncoding: c.encoding}
+		seen := make(map[string]bool)
+
+		for i := 0; i < 1000; i++ {
+			sum := md5.Sum([]byte(strconv.Itoa(i)))
+			hash := storage.formatHash(sum[:])
+
+			s.Len(hash, c.length, hash)
+			s.Regexp(c.pattern, hash)
+			s.False(seen[hash], hash)
+			s.Equal(hash, storage.formatHash(sum[:]))
+			seen[hash] = true
+		}
+
+		// Leading zero bytes keep the length
+		s.Len(storage.formatHash(make([]byte, md5.Size)), c.length)
+	}
+
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "hash_encoding"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.HashEncoding = Base32
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.Regexp(`^css/style\.[a-z2-7]{10}\.css$`, storage.Resolve("css/style.css"))
+
+	fingerprint, err := storage.Fingerprint("img/pix.png")
+	s.Require().NoError(err)
+	s.Equal("img/pix."+fingerprint+".png", storage.Resolve("img/pix.png"))
+}
+
+// shortWriter accepts at most limit bytes and silently drops the rest.
+type shortWriter struct {
+	limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		p = p[:w.limit]
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func (s *StorageTestSuite) TestCopyContent() {
+	err := copyContent(ioutil.Discard, strings.NewReader("abcdef"), 6)
+	s.NoError(err)
+}
+
+func (s *StorageTestSuite) TestCopyContent_ShortWrite() {
+	err := copyContent(&shortWriter{limit: 3}, strings.NewReader("abcdef"), 6)
+	s.Error(err)
+}
+
+func (s *StorageTestSuite) TestCopyContent_SizeMismatch() {
+	err := copyContent(ioutil.Discard, strings.NewReader("abc"), 6)
+	s.Equal(ErrCopySizeMismatch, err)
+}
+
+func (s *StorageTestSuite) TestSetCachePolicy() {
+	storage := &Storage{}
+	s.NoError(storage.SetCachePolicy("fonts/**/*.woff2", "public, max-age=86400"))
+	s.NoError(storage.SetCachePolicy("*.js", "no-cache"))
+
+	s.Equal("public, max-age=86400", storage.matchCachePolicy("fonts/icons.woff2"))
+	s.Equal("public, max-age=86400", storage.matchCachePolicy("fonts/brand/v2/icons.woff2"))
+	s.Equal("", storage.matchCachePolicy("img/icons.woff2"))
+	s.Equal("no-cache", storage.matchCachePolicy("sw.js"))
+	s.Equal("", storage.matchCachePolicy("js/app.js"))
+
+	for _, pattern := range []string{"[", "fonts/[a-]/*.woff2", "*.js\\", "[]a]"} {
+		s.Equal(path.ErrBadPattern, storage.SetCachePolicy(pattern, "no-store"), pattern)
+	}
+	s.Len(storage.cachePolicies, 2)
+}
+
+func (s *StorageTestSuite) TestHandler_CachePolicy() {
+	suffix := "cache"
+	inputDir := filepath.Join(s.InputRootDir, suffix)
+	outputDir := filepath.Join(s.OutputRootDir, suffix)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.SetCachePolicy("sw.js", "no-cache")
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Reload storage to make sure the policy is read from the manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	handler := storage.Handler()
+
+	cases := map[string]string{
+		storage.Resolve("style.css"): DefaultCacheControl,
+		storage.Resolve("sw.js"):     "no-cache",
+	}
+	for storageRelPath, cacheControl := range cases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/"+storageRelPath, nil))
+
+		s.Equal(http.StatusOK, rec.Code)
+		s.Equal(cacheControl, rec.Header().Get("Cache-Control"), storageRelPath)
+	}
+
+	// Unhashed files are revalidated
+	storage, err = NewStorage(filepath.Join(s.OutputRootDir, "cache_no_hash"))
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.NoHashExtensions = []string{".js"}
+	storage.Pin("style.css", "style.css")
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	handler = storage.Handler()
+
+	for _, storageRelPath := range []string{"sw.js", "style.css"} {
+		s.Equal(storageRelPath, storage.Resolve(storageRelPath))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/"+storageRelPath, nil))
+
+		s.Equal(http.StatusOK, rec.Code)
+		s.Equal(RevalidateCacheControl, rec.Header().Get("Cache-Control"), storageRelPath)
+	}
+}
+
+func (s *StorageTestSuite) TestHandler_CleanURLs() {
+	outputDir := filepath.Join(s.OutputRootDir, "clean_urls")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, "css/style.98718311206c.css"))
+	s.Require().NoError(err)
+
+	storage.CleanURLs = true
+	s.Equal("css/style.css", storage.Resolve("css/style.css"))
+
+	rec := httptest.NewRecorder()
+	storage.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/css/style.css", nil))
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal(string(content), rec.Body.String())
+	s.Empty(rec.Header().Get("Cache-Control"))
+
+	// Hashed URLs are still served
+	rec = httptest.NewRecorder()
+	storage.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/css/style.98718311206c.css", nil))
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal(string(content), rec.Body.String())
+}
+
+func (s *StorageTestSuite) TestHandler_ImageVariants() {
+	inputDir := filepath.Join(s.OutputRootDir, "image_variants/input")
+	outputDir := filepath.Join(s.OutputRootDir, "image_variants/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	for name, content := range map[string]string{"photo.png": "png", "photo.webp": "webp", "photo.avif": "avif", "logo.png": "logo"} {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.ImageVariants = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	cases := []struct {
+		accept      string
+		content     string
+		contentType string
+	}{
+		{"image/avif,image/webp,image/apng,*/*;q=0.8", "avif", "image/avif"},
+		{"image/webp,*/*", "webp", "image/webp"},
+		{"image/avif;q=0, image/webp;q=0.9", "webp", "image/webp"},
+		{"*/*", "png", "image/png"},
+		{"", "png", "image/png"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/"+storage.Resolve("photo.png"), nil)
+		req.Header.Set("Accept", c.accept)
+		rec := httptest.NewRecorder()
+		storage.Handler().ServeHTTP(rec, req)
+
+		s.Equal(http.StatusOK, rec.Code, c.accept)
+		s.Equal(c.content, rec.Body.String(), c.accept)
+		s.Equal(c.contentType, rec.Header().Get("Content-Type"), c.accept)
+		s.Equal("Accept", rec.Header().Get("Vary"), c.accept)
+		s.Equal(DefaultCacheControl, rec.Header().Get("Cache-Control"), c.accept)
+	}
+
+	// Images without variants don't vary
+	req := httptest.NewRequest("GET", "/"+storage.Resolve("logo.png"), nil)
+	req.Header.Set("Accept", "image/webp")
+	rec := httptest.NewRecorder()
+	storage.Handler().ServeHTTP(rec, req)
+	s.Equal("logo", rec.Body.String())
+	s.Empty(rec.Header().Get("Vary"))
+}
+
+func (s *StorageTestSuite) TestHandler_Range() {
+	outputDir := filepath.Join(s.OutputRootDir, "range")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.VerifyOnOpen = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storagePath := storage.Resolve("css/style.css")
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, storagePath))
+	s.Require().NoError(err)
+
+	for _, verify := range []bool{false, true} {
+		storage.VerifyOnOpen = verify
+
+		req := httptest.NewRequest("GET", "/"+storagePath, nil)
+		req.Header.Set("Range", "bytes=10-29")
+		rec := httptest.NewRecorder()
+		storage.Handler().ServeHTTP(rec, req)
+
+		s.Equal(http.StatusPartialContent, rec.Code)
+		s.Equal("bytes 10-29/"+strconv.Itoa(len(content)), rec.Header().Get("Content-Range"))
+		s.Equal(string(content[10:30]), rec.Body.String())
+	}
+}
+
+func (s *StorageTestSuite) TestOpen_FallbackToSource() {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "open_fallback")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.Enabled = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	storageRelPath := "img/pix.3eaf17869bb5.png"
+	err = os.Remove(filepath.Join(outputDir, storageRelPath))
+	s.Require().NoError(err)
+
+	_, err = storage.Open(storageRelPath)
+	s.True(os.IsNotExist(err))
+
+	storage.OpenFallbackToSource = true
+	f, err := storage.Open(storageRelPath)
+	s.Require().NoError(err)
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	s.Require().NoError(err)
+	expected, err := ioutil.ReadFile(filepath.Join(inputDir, "img/pix.png"))
+	s.Require().NoError(err)
+	s.Equal(expected, content)
+	s.Contains(logBuf.String(), "Storage file 'img/pix.3eaf17869bb5.png' is missing")
+
+	// Unknown files are still missing
+	_, err = storage.Open("img/file-not-exist.png")
+	s.True(os.IsNotExist(err))
+}
+
+func (s *StorageTestSuite) TestHandler_ModTime() {
+	inputDir := filepath.Join(s.InputRootDir, "base")
+	outputDir := filepath.Join(s.OutputRootDir, "mod_time")
+
+	info, err := os.Stat(filepath.Join(inputDir, "css", "style.css"))
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.RecordModTime = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	// Reload storage to make sure the modification times are read from the manifest
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.True(info.ModTime().Equal(storage.FilesMap["css/style.css"].ModTime))
+
+	storagePath := "/" + storage.Resolve("css/style.css")
+	lastModified := info.ModTime().UTC().Format(http.TimeFormat)
+
+	rec := httptest.NewRecorder()
+	storage.Handler().ServeHTTP(rec, httptest.NewRequest("GET", storagePath, nil))
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal(lastModified, rec.Header().Get("Last-Modified"))
+
+	req := httptest.NewRequest("GET", storagePath, nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rec = httptest.NewRecorder()
+	storage.Handler().ServeHTTP(rec, req)
+	s.Equal(http.StatusNotModified, rec.Code)
+}
+
+func (s *StorageTestSuite) TestReferrers() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "referrers"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal([]string{"css/import.css", "css/style.css"}, storage.Referrers("img/pix.png"))
+	s.Equal([]string{"css/style.css"}, storage.Referrers("/css/import.css"))
+	s.Empty(storage.Referrers("css/style.css"))
+	s.Empty(storage.Referrers("missing.png"))
+}
+
+func (s *StorageTestSuite) TestWatch_Rebuild() {
+	inputDir := filepath.Join(s.OutputRootDir, "watch_rebuild/input")
+	outputDir := filepath.Join(s.OutputRootDir, "watch_rebuild/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	files := map[string]string{
+		"style.css": `div { background: url("pix.png"); }`,
+		"other.css": `div { color: red; }`,
+		"pix.png":   "png",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		s.Require().NoError(err)
+	}
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	var processed []string
+	storage.RegisterRule(func(storage *Storage, file *StaticFile) error {
+		processed = append(processed, file.RelPath)
+		return nil
+	})
+
+	imgPath := filepath.Join(inputDir, "pix.png")
+	err = ioutil.WriteFile(imgPath, []byte("abc"), 0644)
+	s.Require().NoError(err)
+
+	err = storage.rebuild([]string{imgPath}, nil)
+	s.Require().NoError(err)
+
+	sort.Strings(processed)
+	s.Equal([]string{"pix.png", "style.css"}, processed)
+	s.Equal("pix.900150983cd2.png", storage.Resolve("pix.png"))
+
+	content, err := ioutil.ReadFile(filepath.Join(outputDir, storage.Resolve("style.css")))
+	s.Require().NoError(err)
+	s.Equal(`div { background: url("pix.900150983cd2.png"); }`, string(content))
+
+	// Manifest is updated
+	loaded, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	s.Equal("pix.900150983cd2.png", loaded.Resolve("pix.png"))
+
+	// Removed files are dropped
+	processed = nil
+	err = os.Remove(imgPath)
+	s.Require().NoError(err)
+
+	err = storage.rebuild(nil, []string{imgPath})
+	s.Require().NoError(err)
+	s.Equal([]string{"style.css"}, processed)
+	s.NotContains(storage.FilesMap, "pix.png")
+}
+
+func (s *StorageTestSuite) TestWatch() {
+	inputDir := filepath.Join(s.OutputRootDir, "watch/input")
+	outputDir := filepath.Join(s.OutputRootDir, "watch/output")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+
+	stylePath := filepath.Join(inputDir, "style.css")
+	err = ioutil.WriteFile(stylePath, []byte("div {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	rebuilds := make(chan []string, 10)
+	err = storage.Watch(10*time.Millisecond, func(paths []string, err error) {
+		s.NoError(err)
+		rebuilds <- paths
+	})
+	s.Require().NoError(err)
+
+	err = ioutil.WriteFile(stylePath, []byte("p {}"), 0644)
+	s.Require().NoError(err)
+
+	// Make sure the change is visible on the file systems with the coarse timestamps
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(stylePath, future, future)
+	s.Require().NoError(err)
+
+	select {
+	case paths := <-rebuilds:
+		s.Equal([]string{stylePath}, paths)
+	case <-time.After(5 * time.Second):
+		s.Fail("Storage wasn't rebuilt")
+	}
+
+	s.NoError(storage.Close())
+	s.Equal("style.c3ee3d7a4380.css", storage.Resolve("style.css"))
+}
+
+func (s *StorageTestSuite) TestVerify() {
+	outputDir := filepath.Join(s.OutputRootDir, "verify")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.NoError(storage.Verify())
+
+	err = os.Remove(filepath.Join(outputDir, "img/pix.3eaf17869bb5.png"))
+	s.Require().NoError(err)
+
+	storage, err = NewStorage(outputDir)
+	s.Require().NoError(err)
+
+	err = storage.Verify()
+	s.Require().IsType(&MissingFilesError{}, err)
+	s.Equal([]string{"img/pix.3eaf17869bb5.png"}, err.(*MissingFilesError).StorageRelPaths)
+}
+
+func (s *StorageTestSuite) TestWarm() {
+	outputDir := filepath.Join(s.OutputRootDir, "warm")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.Gzip = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+	s.NoError(storage.Warm())
+
+	err = os.Remove(filepath.Join(outputDir, "img/pix.3eaf17869bb5.png"))
+	s.Require().NoError(err)
+	s.True(os.IsNotExist(storage.Warm()))
+
+	storage.Enabled = false
+	s.NoError(storage.Warm())
+}
+
+func (s *StorageTestSuite) TestPreloadLinks() {
+	storage := &Storage{
+		Enabled: true,
+		FilesMap: map[string]*StaticFile{
+			"css/style.css": {
+				RelPath:        "css/style.css",
+				StorageRelPath: "css/style.98718311206c.css",
+			},
+			"fonts/icons.woff2": {
+				RelPath:        "fonts/icons.woff2",
+				StorageRelPath: "fonts/icons.5f15d96d5cdb.woff2",
+			},
+		},
+	}
+
+	links := storage.PreloadLinks([]string{"css/style.css", "/fonts/icons.woff2", "missing.js"})
+	s.Equal([]string{
+		"</css/style.98718311206c.css>; rel=preload; as=style",
+		`</fonts/icons.5f15d96d5cdb.woff2>; rel=preload; as=font; type="font/woff2"; crossorigin`,
+	}, links)
+
+	for _, staticURL := range []string{"/static", "https://cdn.example.com/static/"} {
+		storage.StaticURL = staticURL
+		links = storage.PreloadLinks([]string{"css/style.css"})
+		s.Equal([]string{"<" + strings.TrimSuffix(staticURL, "/") + "/css/style.98718311206c.css>; rel=preload; as=style"}, links, staticURL)
+	}
+}
+
+func (s *StorageTestSuite) TestConcurrentResolve() {
+	inputDir := filepath.Join(s.OutputRootDir, "concurrent_resolve/input")
+	outputDir := filepath.Join(s.OutputRootDir, "concurrent_resolve/output")
+	stylePath := filepath.Join(inputDir, "style.css")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(stylePath, []byte("div {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+	storage.CaseInsensitive = true
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	handler := storage.Handler()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resolved := storage.Resolve("STYLE.css")
+				s.True(strings.HasPrefix(resolved, "style."), resolved)
+				storage.IsManaged(resolved)
+
+				if f, err := storage.Open(resolved); err == nil {
+					f.Close()
+				}
+
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+resolved, nil))
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		err = ioutil.WriteFile(stylePath, []byte("div { z-index: "+strconv.Itoa(i)+"; }"), 0644)
+		s.Require().NoError(err)
+
+		if i%2 == 0 {
+			err = storage.rebuild([]string{stylePath}, nil)
+		} else {
+			err = storage.CollectStatic()
+		}
+		s.Require().NoError(err)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	s.Equal("style.28f055347b52.css", storage.Resolve("style.css"))
+}
+
+func (s *StorageTestSuite) TestConcurrentReaders() {
+	inputDir := filepath.Join(s.OutputRootDir, "concurrent_readers/input")
+	outputDir := filepath.Join(s.OutputRootDir, "concurrent_readers/output")
+	stylePath := filepath.Join(inputDir, "style.css")
+
+	err := os.MkdirAll(inputDir, 0755)
+	s.Require().NoError(err)
+	err = ioutil.WriteFile(stylePath, []byte("div {}"), 0644)
+	s.Require().NoError(err)
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				fileCount, _ := storage.Stats()
+				s.Equal(1, fileCount)
+				s.NoError(storage.WriteManifest(ioutil.Discard))
+				s.NoError(storage.WriteReport(ioutil.Discard))
+				storage.Verify()
+				storage.Warm()
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		err = ioutil.WriteFile(stylePath, []byte("div { z-index: "+strconv.Itoa(i)+"; }"), 0644)
+		s.Require().NoError(err)
+
+		if i%2 == 0 {
+			err = storage.rebuild([]string{stylePath}, nil)
+		} else {
+			err = storage.CollectStatic()
+		}
+		s.Require().NoError(err)
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func (s *StorageTestSuite) TestResolve_DuringCollection() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "resolve_during_collection"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "broken_url"))
+
+	var fallbackResolved, index string
+	storage.URLRewriteFallback = func(rawURL string) (string, bool) {
+		fallbackResolved = storage.ResolveURLWith("/static/", "style.css")
+		return "", false
+	}
+	storage.RegisterGlobalRule(func(storage *Storage) error {
+		index = storage.Resolve("style.css")
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- storage.CollectStatic()
+	}()
+
+	select {
+	case err = <-done:
+		s.Require().NoError(err)
+	case <-time.After(5 * time.Second):
+		s.FailNow("Storage wasn't collected")
+	}
+
+	// Rules see the files of the running collection
+	s.Equal("/static/style.9015bcd6dd2f.css", fallbackResolved)
+	s.Equal("style.9015bcd6dd2f.css", index)
+	s.Equal(index, storage.Resolve("style.css"))
+}
+
+func (s *StorageTestSuite) TestIsManaged() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "is_managed"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.True(storage.IsManaged("css/style.98718311206c.css"))
+	s.True(storage.IsManaged("/css/style.98718311206c.css"))
+	s.False(storage.IsManaged("css/style.css"))
+	s.False(storage.IsManaged("robots.txt"))
+}
+
+func (s *StorageTestSuite) readArchive(data []byte, format ArchiveFormat) map[string][]byte {
+	entries := make(map[string][]byte)
+
+	switch format {
+	case ArchiveTarGz:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		s.Require().NoError(err)
+
+		tr := tar.NewReader(zr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			s.Require().NoError(err)
+
+			entries[header.Name], err = ioutil.ReadAll(tr)
+			s.Require().NoError(err)
+		}
+	case ArchiveZip:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		s.Require().NoError(err)
+
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			s.Require().NoError(err)
+
+			entries[f.Name], err = ioutil.ReadAll(rc)
+			s.Require().NoError(err)
+			rc.Close()
+		}
+	}
+
+	return entries
+}
+
+func (s *StorageTestSuite) TestCollectToArchive() {
+	expectedDir := filepath.Join(s.ExpectedRootDir, "base")
+
+	for name, format := range map[string]ArchiveFormat{"tar_gz": ArchiveTarGz, "zip": ArchiveZip} {
+		storage, err := NewStorage(filepath.Join(s.OutputRootDir, "archive", name))
+		s.Require().NoError(err)
+		storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+
+		var buf bytes.Buffer
+		err = storage.CollectToArchive(&buf, format)
+		s.Require().NoError(err)
+
+		entries := s.readArchive(buf.Bytes(), format)
+
+		var names []string
+		for entryName, content := range entries {
+			names = append(names, entryName)
+
+			expected, err := ioutil.ReadFile(filepath.Join(expectedDir, entryName))
+			s.Require().NoError(err)
+			s.Equal(string(expected), string(content), entryName)
+		}
+		sort.Strings(names)
+
+		s.Equal([]string{
+			"css/import.5f15d96d5cdb.css",
+			"css/style.98718311206c.css",
+			"css/style.css.8a80554c91d9.map",
+			"img/pix.3eaf17869bb5.png",
+			ManifestFilename,
+		}, names, name)
+	}
+}
+
+func (s *StorageTestSuite) TestCollectToArchive_LatestAlias() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "archive_latest"))
+	s.Require().NoError(err)
+	storage.AddInputDir(filepath.Join(s.InputRootDir, "base"))
+	storage.EmitLatestAlias = true
+
+	var buf bytes.Buffer
+	err = storage.CollectToArchive(&buf, ArchiveZip)
+	s.Require().NoError(err)
+
+	entries := s.readArchive(buf.Bytes(), ArchiveZip)
+	for _, relPath := range []string{"css/style.css", "img/pix.png"} {
+		latestRelPath := LatestDir + "/" + relPath
+		s.Require().Contains(entries, latestRelPath)
+		s.Equal(entries[storage.Resolve(relPath)], entries[latestRelPath], relPath)
+	}
+}
+
+func (s *StorageTestSuite) TestCollectToArchive_UnknownFormat() {
+	storage, err := NewStorage(filepath.Join(s.OutputRootDir, "archive_unknown"))
+	s.Require().NoError(err)
+
+	err = storage.CollectToArchive(ioutil.Discard, ArchiveFormat(-1))
+	s.Equal(ErrUnknownArchiveFormat, err)
+}
+
+func BenchmarkHashAndCopy(b *testing.B) {
+	dir, err := ioutil.TempDir("", "staticfiles")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "src.bin")
+	err = ioutil.WriteFile(srcPath, bytes.Repeat([]byte("staticfiles"), 1<<16), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	storage := &Storage{}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dst, _, err := storage.hashAndCopy(srcPath, dir, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		os.Remove(dst)
+	}
+}
+
+func (s *StorageTestSuite) TestRewriteMiddleware_HTML() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	handler := storage.RewriteMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<link rel="stylesheet" href="/static/css/style.css">`))
+		w.Write([]byte(`<img src="/static/img/pix.png"><img src="/static/img/mypix.png">`))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	expected := `<link rel="stylesheet" href="/static/css/style.98718311206c.css">` +
+		`<img src="/static/img/pix.3eaf17869bb5.png"><img src="/static/img/mypix.png">`
+	s.Equal(http.StatusOK, rec.Code)
+	s.Equal(expected, rec.Body.String())
+	s.Equal(strconv.Itoa(len(expected)), rec.Header().Get("Content-Length"))
+}
+
+func (s *StorageTestSuite) TestRewriteMiddleware_NotHTML() {
+	storage, err := NewStorage("testdata/expected/base")
+	s.Require().NoError(err)
+
+	body := `{"style": "css/style.css"}`
+	handler := storage.RewriteMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(body))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	s.Equal(http.StatusCreated, rec.Code)
+	s.Equal(body, rec.Body.String())
+}
+
+// recordingProcessor records the lifecycle calls.
+type recordingProcessor struct {
+	name  string
+	calls *[]string
+}
+
+func (p *recordingProcessor) Setup(*Storage) error {
+	*p.calls = append(*p.calls, p.name+".Setup")
+	return nil
+}
+
+func (p *recordingProcessor) Process(storage *Storage, file *StaticFile) error {
+	*p.calls = append(*p.calls, p.name+".Process "+file.RelPath)
+	return nil
+}
+
+func (p *recordingProcessor) Teardown() error {
+	*p.calls = append(*p.calls, p.name+".Teardown")
+	return nil
+}
+
+func (s *StorageTestSuite) TestRegisterProcessor() {
+	inputDir := filepath.Join(s.InputRootDir, "broken_url")
+	outputDir := filepath.Join(s.OutputRootDir, "processor")
+
+	storage, err := NewStorage(outputDir)
+	s.Require().NoError(err)
+	storage.AddInputDir(inputDir)
+
+	var calls []string
+	storage.RegisterProcessor(&recordingProcessor{name: "first", calls: &calls})
+	storage.RegisterRule(func(storage *Storage, file *StaticFile) error {
+		calls = append(calls, "rule "+file.RelPath)
+		return nil
+	})
+	storage.RegisterProcessor(&recordingProcessor{name: "second", calls: &calls})
+
+	err = storage.CollectStatic()
+	s.Require().NoError(err)
+
+	s.Equal([]string{
+		"first.Setup",
+		"second.Setup",
+		"first.Process style.css",
+		"rule style.css",
+		"second.Process style.css",
+		"second.Teardown",
+		"first.Teardown",
+	}, calls)
+}
+
+func benchmarkPostProcess(b *testing.B, workers int) {
+	dir, err := ioutil.TempDir("", "staticfiles")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inputDir := filepath.Join(dir, "input")
+	err = os.MkdirAll(filepath.Join(inputDir, "img"), 0755)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	css := bytes.Repeat([]byte("div { background: url(\"img/pix.png\"); }\n"), 1000)
+	for i := 0; i < 100; i++ {
+		err = ioutil.WriteFile(filepath.Join(inputDir, "style"+strconv.Itoa(i)+".css"), css, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(inputDir, "img/pix.png"), []byte("png"), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	storage, err := NewStorage(filepath.Join(dir, "output"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	storage.AddInputDir(inputDir)
+	storage.Workers = workers
+
+	filesMap, err := storage.collectFiles()
+	if err != nil {
+		b.Fatal(err)
+	}
+	storage.setFilesMap(filesMap)
+
+	var files []*StaticFile
+	for _, sf := range filesMap {
+		files = append(files, sf)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err = storage.postProcessFiles(files)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPostProcess_Serial(b *testing.B) {
+	benchmarkPostProcess(b, 1)
+}
+
+func BenchmarkPostProcess_Parallel(b *testing.B) {
+	benchmarkPostProcess(b, runtime.NumCPU())
 }
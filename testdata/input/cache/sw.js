@@ -0,0 +1 @@
+self.addEventListener("fetch", function () {});
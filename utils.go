@@ -1,6 +1,21 @@
 package staticfiles
 
-import "regexp"
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// binarySampleSize is the number of the first file bytes inspected by IsBinary.
+const binarySampleSize = 512
 
 func findSubmatchGroup(regex *regexp.Regexp, s, groupName string) string {
 	matches := regex.FindStringSubmatch(s)
@@ -15,3 +30,259 @@ func findSubmatchGroup(regex *regexp.Regexp, s, groupName string) string {
 
 	return ""
 }
+
+// matchPath reports whether the slash-separated path matches the glob-style pattern.
+// Pattern elements are matched with path.Match, except "**" matching
+// zero or more path elements. Malformed patterns match nothing.
+func matchPath(pattern, name string) bool {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchElements(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(patterns[0], names[0]); !ok || err != nil {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+
+	return len(names) == 0
+}
+
+// validPattern reports whether the slash-separated glob-style pattern is well-formed
+// according to the path.Match syntax. Malformed patterns aren't always reported
+// by path.Match, e.g. when the name doesn't match before the malformed part.
+func validPattern(pattern string) bool {
+	for _, element := range strings.Split(pattern, "/") {
+		if !validElement(element) {
+			return false
+		}
+	}
+	return true
+}
+
+func validElement(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i == len(pattern) {
+				return false
+			}
+		case '[':
+			i++
+			if i < len(pattern) && pattern[i] == '^' {
+				i++
+			}
+
+			var ok bool
+			for n := 0; i < len(pattern) && (pattern[i] != ']' || n == 0); n++ {
+				if i, ok = classChar(pattern, i); !ok {
+					return false
+				}
+				if i < len(pattern) && pattern[i] == '-' {
+					if i, ok = classChar(pattern, i+1); !ok {
+						return false
+					}
+				}
+			}
+
+			// Character class isn't closed
+			if i == len(pattern) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// classChar returns the index following the possibly escaped character
+// of the character class starting at the index i of the pattern.
+func classChar(pattern string, i int) (int, bool) {
+	if i == len(pattern) || pattern[i] == '-' || pattern[i] == ']' {
+		return i, false
+	}
+
+	if pattern[i] == '\\' {
+		if i++; i == len(pattern) {
+			return i, false
+		}
+	}
+	return i + 1, true
+}
+
+// IsBinary reports whether the file looks like a binary one,
+// i.e. its first bytes contain a NUL byte.
+func IsBinary(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySampleSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	return bytes.IndexByte(buf[:n], 0) != -1, nil
+}
+
+// filesEqual reports whether the files have the same content.
+func filesEqual(path1, path2 string) (bool, error) {
+	content1, err := ioutil.ReadFile(path1)
+	if err != nil {
+		return false, err
+	}
+
+	content2, err := ioutil.ReadFile(path2)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(content1, content2), nil
+}
+
+// joinURL joins the base URL and the path using a single slash.
+func joinURL(base, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// isWithinDir reports whether the path is located in the directory dir
+// or is the directory itself. Both paths must be absolute.
+func isWithinDir(dir, path string) bool {
+	relPath, err := filepath.Rel(dir, path)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+// isImageExt reports whether the file extension belongs to an image format
+// which may have the Storage.ImageVariants.
+func isImageExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// imageType returns the MIME type of the image file extension. The modern formats
+// are listed explicitly since they may be missing in the system MIME types.
+func imageType(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".avif":
+		return "image/avif"
+	case ".webp":
+		return "image/webp"
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// acceptsType reports whether the Accept header value explicitly lists
+// the media type with a non-zero quality. Wildcards aren't taken into account,
+// since clients send "*/*" regardless of the supported image formats.
+func acceptsType(accept, mediaType string) bool {
+	if mediaType == "" {
+		return false
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		acceptType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || !strings.EqualFold(acceptType, mediaType) {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// withPath returns the shallow copy of the request with the URL path replaced.
+func withPath(r *http.Request, urlPath string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+
+	u := *r.URL
+	u.Path = urlPath
+	u.RawPath = ""
+	r2.URL = &u
+
+	return r2
+}
+
+// nameExt returns the file name extension like filepath.Ext does,
+// except the dotfiles without other dots, e.g. ".htaccess", have no extension.
+func nameExt(path string) string {
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) {
+		return ""
+	}
+	return ext
+}
+
+// isEmptyDir reports whether the directory with the path has no entries.
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// detectContentType returns the MIME type of the file by its extension
+// or by its first bytes if the extension is unknown.
+func detectContentType(path string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sample := make([]byte, binarySampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	return http.DetectContentType(sample[:n]), nil
+}
+
+// contentTypeOf is like detectContentType but sniffs the file content read already,
+// e.g. the one written to the Storage.OutputBackend.
+func contentTypeOf(path string, content []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+
+	if len(content) > binarySampleSize {
+		content = content[:binarySampleSize]
+	}
+	return http.DetectContentType(content)
+}
@@ -0,0 +1,182 @@
+package staticfiles
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// fileState is the state of the input file compared between the polls.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watch polls the input directories every interval in the background and
+// rebuilds the storage incrementally when the files are added, changed or removed.
+// Only the changed files are hashed and copied, the files referencing them
+// (see Storage.Referrers) are post-processed again to update the references
+// and the manifest is saved. Removed files are dropped from the Storage.FilesMap.
+// The reference graph is recorded during the collection, so Watch is expected
+// to be called after CollectStatic.
+//
+// onRebuild, if not nil, is called after each rebuild with the paths of
+// the changed input files and the error occurred. The watcher is stopped by Close.
+// Resolve, Open and the handlers are safe for use during the rebuilds,
+// while the other Storage methods aren't, so Watch is intended for development.
+func (s *Storage) Watch(interval time.Duration, onRebuild func(paths []string, err error)) error {
+	snapshot, err := s.snapshotInputs()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			current, err := s.snapshotInputs()
+			if err != nil {
+				if onRebuild != nil {
+					onRebuild(nil, err)
+				}
+				continue
+			}
+
+			changed, removed := diffSnapshots(snapshot, current)
+			if len(changed) == 0 && len(removed) == 0 {
+				continue
+			}
+			snapshot = current
+
+			err = s.rebuild(changed, removed)
+			if onRebuild != nil {
+				onRebuild(append(changed, removed...), err)
+			}
+		}
+	}()
+
+	s.addCloser(func() error {
+		close(stop)
+		<-stopped
+		return nil
+	})
+
+	return nil
+}
+
+// snapshotInputs returns the states of the files in the input directories mapped to their paths.
+func (s *Storage) snapshotInputs() (map[string]fileState, error) {
+	snapshot := make(map[string]fileState)
+
+	for _, dir := range s.inputDirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() {
+				snapshot[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}
+
+// diffSnapshots returns the sorted paths of the added or changed
+// and the removed files between the snapshots.
+func diffSnapshots(prev, current map[string]fileState) (changed, removed []string) {
+	for path, state := range current {
+		if prevState, ok := prev[path]; !ok || prevState != state {
+			changed = append(changed, path)
+		}
+	}
+
+	for path := range prev {
+		if _, ok := current[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+
+	sort.Strings(changed)
+	sort.Strings(removed)
+	return changed, removed
+}
+
+// rebuild collects the changed files, drops the removed ones, post-processes
+// the files referencing any of them and saves the manifest.
+func (s *Storage) rebuild(changed, removed []string) error {
+	s.buildLock.Lock()
+	defer s.buildLock.Unlock()
+
+	err := s.checkOutput()
+	if err != nil {
+		return err
+	}
+
+	filesMap := s.copyFilesMap()
+	files, err := s.collectPaths(changed, filesMap)
+	if err != nil {
+		return err
+	}
+
+	relPaths := make([]string, 0, len(files)+len(removed))
+	for _, sf := range files {
+		relPaths = append(relPaths, sf.RelPath)
+	}
+
+	for _, path := range removed {
+		dir, relPath, err := s.findInputDir(path)
+		if err != nil {
+			return err
+		}
+
+		relPath = s.inputPrefixes[dir] + relPath
+		delete(filesMap, relPath)
+		s.setReferences(relPath, nil)
+		relPaths = append(relPaths, relPath)
+	}
+	s.setFilesMap(filesMap)
+
+	// Names of the referencing files are hashed from their original content,
+	// so they are kept, while the references in them are outdated
+	seen := make(map[*StaticFile]bool, len(files))
+	for _, sf := range files {
+		seen[sf] = true
+	}
+
+	// The referencing files are renamed with the Storage.HashDependencies,
+	// so the files referencing them are updated as well
+	for i := 0; i < len(relPaths); i++ {
+		for _, referrer := range s.Referrers(relPaths[i]) {
+			if sf, ok := s.FilesMap[referrer]; ok && !seen[sf] {
+				seen[sf] = true
+				files = append(files, sf)
+
+				if s.HashDependencies {
+					relPaths = append(relPaths, referrer)
+				}
+			}
+		}
+	}
+
+	return s.finishCollecting(files)
+}